@@ -0,0 +1,499 @@
+// Package admin HTTP API для поддержки: снапшоты рейтингов, место, чанк и награда пользователя,
+// его последние события, словари наград и внеочередной запуск задания
+//
+//	GET  /jobs                              задания конфига и ключи их текущих снапшотов
+//	GET  /jobs/{job}/snapshot?period=&offset=&limit=  только задания events, снапшоты хранят только они
+//	GET  /jobs/{job}/users/{user_id}?period=  у rewards и dislikes по текущему рейтингу источника
+//	GET  /jobs/{job}/dict
+//	POST /jobs/{job}/run
+//	GET  /users/{user_id}/events?limit=&rating=  история пишется получателем user_events
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"ratings_filters/helpers"
+	"ratings_filters/jobs"
+	r "ratings_filters/rating_filter"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLimit строк снапшота или событий в одном ответе, если limit не задан
+	defaultLimit = 100
+	maxLimit     = 10000
+)
+
+// errBadRequest ошибки параметров запроса, отвечаем 400
+var errBadRequest = errors.New("bad request")
+
+// Server обработчики админки поверх снапшотов и словарей заданий конфига
+type Server struct {
+	Config *jobs.Config
+	Deps   jobs.Deps
+	// Trigger внеочередной запуск задания, обычно Scheduler.Trigger, nil - запуск недоступен
+	Trigger func(job string) (runID string, err error)
+	// Token запросы передают заголовок Authorization: Bearer <Token>, пустой - все запросы отклоняются
+	Token string
+	// now текущее время для периода снапшота, в тестах подменяется
+	now func() time.Time
+}
+
+// Handler маршруты админки
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.HandleFunc("/users/", s.handleUser)
+	return s.authorize(mux)
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		if s.Token == "" || !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type jobView struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Key ключ снапшота текущего периода, у заданий без снапшотов пустой
+	Key string `json:"key,omitempty"`
+}
+
+// kindOf тип задания с учётом умолчания
+func kindOf(job jobs.JobConfig) string {
+	if job.Kind == "" {
+		return jobs.KindEvents
+	}
+	return job.Kind
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	views := make([]jobView, 0, len(s.Config.Jobs))
+	for _, job := range s.Config.Jobs {
+		view := jobView{Name: job.Name, Kind: kindOf(job)}
+		if view.Kind == jobs.KindEvents {
+			view.Key = s.Config.Key(job, s.time()).String()
+		}
+		views = append(views, view)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleJob /jobs/{job}/snapshot, /jobs/{job}/users/{user_id}, /jobs/{job}/dict, /jobs/{job}/run
+func (s *Server) handleJob(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/"), "/")
+	job, err := s.Config.Job(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "snapshot":
+		if allowMethod(w, req, http.MethodGet) {
+			s.handleSnapshot(w, req, job)
+		}
+	case len(parts) == 3 && parts[1] == "users":
+		if allowMethod(w, req, http.MethodGet) {
+			s.handleRank(w, req, job, parts[2])
+		}
+	case len(parts) == 2 && parts[1] == "dict":
+		if allowMethod(w, req, http.MethodGet) {
+			s.handleDict(w, req, job)
+		}
+	case len(parts) == 2 && parts[1] == "run":
+		if allowMethod(w, req, http.MethodPost) {
+			s.handleRun(w, job)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// handleUser /users/{user_id}/events
+func (s *Server) handleUser(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/users/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "events" {
+		http.NotFound(w, req)
+		return
+	}
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	userID, err := parseUserID(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(req, "limit", defaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// с фильтром по рейтингу читаем историю целиком, иначе limit срежет события нужного рейтинга
+	rating := req.URL.Query().Get("rating")
+	fetchLimit := limit
+	if rating != "" {
+		fetchLimit = 0
+	}
+	events, err := helpers.GetUserEvents(req.Context(), s.Deps.Redis, s.Config.Env, userID, fetchLimit)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if rating != "" {
+		filtered := events[:0]
+		for _, e := range events {
+			if e.Rating == rating {
+				filtered = append(filtered, e)
+			}
+		}
+		events = filtered
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+type snapshotView struct {
+	Key string `json:"key"`
+	// Total пользователей в снапшоте, Rows - страница offset/limit
+	Total int       `json:"total"`
+	Rows  []rowView `json:"rows"`
+}
+
+type rowView struct {
+	// Rank место после фильтра задания, 0 - снапшот хранит только чанки
+	Rank   int    `json:"rank,omitempty"`
+	UserID uint32 `json:"user_id"`
+	Value  int64  `json:"value,omitempty"`
+	Chunk  int    `json:"chunk"`
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, req *http.Request, job jobs.JobConfig) {
+	if kind := kindOf(job); kind != jobs.KindEvents {
+		writeError(w, http.StatusNotImplemented, errors.Errorf("%s job %q keeps no snapshots", kind, job.Name))
+		return
+	}
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(req, "limit", defaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	key, err := s.key(req, job)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rows, err := s.loadSnapshot(req.Context(), job, key)
+	if err != nil {
+		writeError(w, statusOf(err), errors.WithMessagef(err, "snapshot %s", key))
+		return
+	}
+
+	view := snapshotView{Key: key.String(), Total: len(rows), Rows: []rowView{}}
+	if offset < len(rows) {
+		end := offset + limit
+		if end > len(rows) {
+			end = len(rows)
+		}
+		view.Rows = rows[offset:end]
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+type rankView struct {
+	Job  string `json:"job"`
+	Kind string `json:"kind"`
+	// Key ключ снапшота, у rewards и dislikes пустой: место считается по источнику
+	Key string `json:"key,omitempty"`
+	rowView
+	// Size пользователей в снапшоте или в отфильтрованном рейтинге источника, от него считаются процентные полосы наград
+	Size int `json:"size"`
+	// Reward награда за это место по словарю задания, если он есть и известно место
+	Reward *rewardView `json:"reward,omitempty"`
+}
+
+type rewardView struct {
+	FactorRuby int64 `json:"factor_ruby"`
+	FactorVIP  int64 `json:"factor_vip"`
+}
+
+func (s *Server) handleRank(w http.ResponseWriter, req *http.Request, job jobs.JobConfig, rawUserID string) {
+	userID, err := parseUserID(rawUserID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if kindOf(job) != jobs.KindEvents {
+		s.handleRewardRank(w, req, job, userID)
+		return
+	}
+	key, err := s.key(req, job)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rows, err := s.loadSnapshot(req.Context(), job, key)
+	if err != nil {
+		writeError(w, statusOf(err), errors.WithMessagef(err, "snapshot %s", key))
+		return
+	}
+
+	view := rankView{Job: job.Name, Kind: jobs.KindEvents, Key: key.String(), Size: len(rows)}
+	found := false
+	for _, row := range rows {
+		if row.UserID == userID {
+			view.rowView = row
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errors.Errorf("user %d is not in snapshot %s", userID, key))
+		return
+	}
+
+	if job.Rewards != "" && view.Rank > 0 {
+		dict, err := jobs.Dict(job, s.Deps)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		reward := dict.GetReward(view.Rank, view.Size, view.Value)
+		view.Reward = &rewardView{FactorRuby: reward.GetFactorRuby(), FactorVIP: reward.GetFactorVIP()}
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleRewardRank место и награда пользователя задания rewards или dislikes: снапшотов они не хранят,
+// поэтому берём текущий рейтинг источника и фильтр задания, как при выплате
+func (s *Server) handleRewardRank(w http.ResponseWriter, req *http.Request, job jobs.JobConfig, userID uint32) {
+	scope, err := jobs.RewardScope(job, s.Deps)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	source, err := jobs.RewardSource(job, s.Deps, s.time())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rating, err := source.GetRating(req.Context())
+	if err != nil {
+		writeError(w, statusOf(err), errors.WithMessage(err, "cannot get current rating"))
+		return
+	}
+
+	// места и размер как при выплате: место из источника, размер после фильтра
+	view := rankView{Job: job.Name, Kind: kindOf(job)}
+	found := false
+	for _, item := range rating {
+		if scope.RatingFilter(item) {
+			continue
+		}
+		view.Size++
+		if item.GetUserID() == userID {
+			view.rowView = rowView{Rank: int(item.GetRank()), UserID: userID, Value: item.GetValue()}
+			found = true
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errors.Errorf("user %d is not in the current rating of %q", userID, job.Name))
+		return
+	}
+	reward := scope.PayerRatings.GetReward(view.Rank, view.Size, view.Value)
+	view.Reward = &rewardView{FactorRuby: reward.GetFactorRuby(), FactorVIP: reward.GetFactorVIP()}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// bandsDict словарь наград, который умеет показать своё содержимое
+type bandsDict interface {
+	Bands() []helpers.RewardBand
+}
+
+type dictView struct {
+	Job   string               `json:"job"`
+	Table string               `json:"table"`
+	Bands []helpers.RewardBand `json:"bands"`
+}
+
+func (s *Server) handleDict(w http.ResponseWriter, req *http.Request, job jobs.JobConfig) {
+	if job.Rewards == "" {
+		writeError(w, http.StatusNotFound, errors.Errorf("job %q has no rewards", job.Name))
+		return
+	}
+	dict, err := jobs.Dict(job, s.Deps)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	bands, ok := dict.(bandsDict)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.Errorf("job %q dictionary cannot list bands", job.Name))
+		return
+	}
+	writeJSON(w, http.StatusOK, dictView{Job: job.Name, Table: job.Rewards, Bands: bands.Bands()})
+}
+
+type runView struct {
+	Job   string `json:"job"`
+	RunID string `json:"run_id"`
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, job jobs.JobConfig) {
+	if s.Trigger == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("runs are not available"))
+		return
+	}
+	runID, err := s.Trigger(job.Name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, runView{Job: job.Name, RunID: runID})
+}
+
+// loadSnapshot строки снапшота по местам, снапшот из чанков - по чанкам и пользователям
+func (s *Server) loadSnapshot(ctx context.Context, job jobs.JobConfig, key helpers.RatingKey) ([]rowView, error) {
+	if job.Store.ChunkMap {
+		chunks, err := helpers.GetChunkMap(ctx, s.Deps.Redis, key)
+		if err != nil {
+			return nil, err
+		}
+		rows := make([]rowView, 0, len(chunks))
+		for userID, chunk := range chunks {
+			rows = append(rows, rowView{UserID: userID, Chunk: chunk})
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Chunk != rows[j].Chunk {
+				return rows[i].Chunk < rows[j].Chunk
+			}
+			return rows[i].UserID < rows[j].UserID
+		})
+		return rows, nil
+	}
+
+	// в снапшоте рейтинг уже после фильтра задания, место - позиция в нём
+	rating, err := helpers.GetPreviousRating(ctx, s.Deps.Redis, key)
+	if err != nil {
+		return nil, err
+	}
+	chunks := r.RatingChunks(rating, job.Chunks)
+	rows := make([]rowView, 0, len(rating))
+	for idx, item := range rating {
+		rows = append(rows, rowView{
+			Rank:   idx + 1,
+			UserID: item.GetUserID(),
+			Value:  item.GetValue(),
+			Chunk:  chunks[item.GetUserID()],
+		})
+	}
+	return rows, nil
+}
+
+// key ключ снапшота задания, period в запросе переопределяет текущий период
+func (s *Server) key(req *http.Request, job jobs.JobConfig) (helpers.RatingKey, error) {
+	key := s.Config.Key(job, s.time())
+	if period := req.URL.Query().Get("period"); period != "" {
+		key.Period = period
+	}
+	err := key.Validate()
+	if err != nil {
+		return key, errors.WithMessage(errBadRequest, err.Error())
+	}
+	return key, nil
+}
+
+func (s *Server) time() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func allowMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", req.Method))
+	return false
+}
+
+func parseUserID(raw string) (uint32, error) {
+	userID, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return 0, errors.WithMessagef(errBadRequest, "invalid user id %q", raw)
+	}
+	return uint32(userID), nil
+}
+
+func queryInt(req *http.Request, name string, def int) (int, error) {
+	raw := req.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return 0, errors.WithMessagef(errBadRequest, "invalid %s %q", name, raw)
+	}
+	if name == "limit" && v > maxLimit {
+		return 0, errors.WithMessagef(errBadRequest, "limit is over %d", maxLimit)
+	}
+	return v, nil
+}
+
+// statusOf код ответа по ошибке хранилища или планировщика
+func statusOf(err error) int {
+	switch errors.Cause(err) {
+	case r.ErrNotFound:
+		return http.StatusNotFound
+	case errBadRequest:
+		return http.StatusBadRequest
+	case jobs.ErrJobRunning, r.ErrLocked:
+		return http.StatusConflict
+	case jobs.ErrSchedulerStopped:
+		return http.StatusServiceUnavailable
+	case context.Canceled, context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+type errorView struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorView{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,260 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/ory/dockertest"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	dt "packages/tests/dockertest" // внутренняя библиотека хелперов для докертеста
+	approto "proto-compile"
+	"ratings_filters/helpers"
+	"ratings_filters/jobs"
+	r "ratings_filters/rating_filter"
+	"testing"
+	"time"
+)
+
+var redisTest redis.Pool
+
+func TestMain(m *testing.M) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		panic("create pool error: " + err.Error())
+	}
+
+	redisImage, redisTag := dt.RedisImage()
+	password := "pswd"
+	optsRedis := dt.RunRedisOpts{
+		RunOptions: &dockertest.RunOptions{
+			Hostname:   "redisAdmin",
+			Repository: redisImage,
+			Tag:        redisTag,
+			Cmd:        []string{"redis-server", "--port", "6300", "--requirepass", password},
+		},
+		Targets: []*redis.Pool{
+			&redisTest,
+		},
+		Password: password,
+	}
+
+	resourceRedis, initedRedis := dt.MustRunRedis(pool, optsRedis)
+	// wait for init
+	<-initedRedis
+
+	_ = resourceRedis.Expire(30)
+
+	m.Run()
+
+	// purge it
+	err = pool.Purge(resourceRedis)
+	if err != nil {
+		panic("purge resource error: " + err.Error())
+	}
+}
+
+func newTestServer(trigger func(job string) (string, error)) *Server {
+	return &Server{
+		Config: &jobs.Config{
+			Env: "develop",
+			Jobs: []jobs.JobConfig{
+				{Name: "likes", Chunks: [][2]int{{1, 2}, {3, 10}}},
+				{Name: "payers", Kind: jobs.KindRewards},
+				{Name: "comments", Store: jobs.StoreConfig{ChunkMap: true}},
+			},
+		},
+		Deps:    jobs.Deps{Redis: redisTest},
+		Trigger: trigger,
+		Token:   "secret",
+		now: func() time.Time {
+			return time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+		},
+	}
+}
+
+func do(t *testing.T, handler http.Handler, method, path string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var body map[string]interface{}
+	if rec.Body.Len() > 0 && rec.Body.Bytes()[0] == '{' {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	}
+	return rec.Code, body
+}
+
+func TestServerJobs(t *testing.T) {
+	handler := newTestServer(nil).Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// токен без схемы Bearer не принимается
+	req.Header.Set("Authorization", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var views []jobView
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &views))
+	require.Equal(t, []jobView{
+		{Name: "likes", Kind: jobs.KindEvents, Key: "rating:develop:likes:20210310"},
+		{Name: "payers", Kind: jobs.KindRewards},
+		{Name: "comments", Kind: jobs.KindEvents, Key: "rating:develop:comments:20210310"},
+	}, views)
+}
+
+func TestServerBadRequests(t *testing.T) {
+	handler := newTestServer(nil).Handler()
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/jobs/views/snapshot", http.StatusNotFound},
+		{http.MethodGet, "/jobs/likes/unknown", http.StatusNotFound},
+		{http.MethodPost, "/jobs/likes/snapshot", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/jobs/likes/snapshot?limit=-1", http.StatusBadRequest},
+		{http.MethodGet, "/jobs/likes/snapshot?limit=100000", http.StatusBadRequest},
+		{http.MethodGet, "/jobs/likes/snapshot?period=2021:03", http.StatusBadRequest},
+		{http.MethodGet, "/jobs/likes/users/bob", http.StatusBadRequest},
+		// rewards снапшотов не хранит
+		{http.MethodGet, "/jobs/payers/snapshot", http.StatusNotImplemented},
+		{http.MethodGet, "/jobs/likes/dict", http.StatusNotFound},
+		{http.MethodPost, "/jobs/likes/run", http.StatusNotImplemented},
+		{http.MethodGet, "/users/bob/events", http.StatusBadRequest},
+		{http.MethodGet, "/users/1/history", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		status, _ := do(t, handler, c.method, c.path)
+		require.Equal(t, c.status, status, c.path)
+	}
+}
+
+func TestServerRun(t *testing.T) {
+	running := false
+	handler := newTestServer(func(job string) (string, error) {
+		if running {
+			return "", jobs.ErrJobRunning
+		}
+		running = true
+		return "run-1", nil
+	}).Handler()
+
+	status, _ := do(t, handler, http.MethodGet, "/jobs/likes/run")
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	status, body := do(t, handler, http.MethodPost, "/jobs/likes/run")
+	require.Equal(t, http.StatusAccepted, status)
+	require.Equal(t, "run-1", body["run_id"])
+
+	status, body = do(t, handler, http.MethodPost, "/jobs/likes/run")
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, jobs.ErrJobRunning.Error(), body["error"])
+}
+
+func TestServerSnapshot(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestServer(nil).Handler()
+	key := helpers.RatingKey{Env: "develop", Name: "likes", Period: "20210310"}
+	rating := []*approto.RatingItem{
+		{UserID: proto.Uint32(7), Value: proto.Int64(300)},
+		{UserID: proto.Uint32(3), Value: proto.Int64(200)},
+		{UserID: proto.Uint32(5), Value: proto.Int64(100)},
+	}
+	require.NoError(t, helpers.SaveRating(ctx, redisTest, key, rating, helpers.SnapshotOptions{TTL: time.Minute}))
+
+	status, body := do(t, handler, http.MethodGet, "/jobs/likes/snapshot?offset=1&limit=1")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, key.String(), body["key"])
+	require.Equal(t, float64(3), body["total"])
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"rank": float64(2), "user_id": float64(3), "value": float64(200), "chunk": float64(1)},
+	}, body["rows"])
+
+	// снапшот из чанков: строки по чанкам и пользователям, без мест
+	chunksKey := helpers.RatingKey{Env: "develop", Name: "comments", Period: "20210310"}
+	require.NoError(t, helpers.SaveChunkMap(ctx, redisTest, chunksKey, map[uint32]int{9: 2, 4: 1, 6: 1}, nil, helpers.SnapshotOptions{TTL: time.Minute}))
+	status, body = do(t, handler, http.MethodGet, "/jobs/comments/snapshot")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"user_id": float64(4), "chunk": float64(1)},
+		map[string]interface{}{"user_id": float64(6), "chunk": float64(1)},
+		map[string]interface{}{"user_id": float64(9), "chunk": float64(2)},
+	}, body["rows"])
+
+	status, _ = do(t, handler, http.MethodGet, "/jobs/likes/snapshot?period=20210309")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerRank(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestServer(nil).Handler()
+	key := helpers.RatingKey{Env: "develop", Name: "likes", Period: "20210311"}
+	rating := []*approto.RatingItem{
+		{UserID: proto.Uint32(7), Value: proto.Int64(300)},
+		{UserID: proto.Uint32(3), Value: proto.Int64(200)},
+		{UserID: proto.Uint32(5), Value: proto.Int64(100)},
+	}
+	require.NoError(t, helpers.SaveRating(ctx, redisTest, key, rating, helpers.SnapshotOptions{TTL: time.Minute}))
+
+	status, body := do(t, handler, http.MethodGet, "/jobs/likes/users/5?period=20210311")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]interface{}{
+		"job":     "likes",
+		"kind":    jobs.KindEvents,
+		"key":     key.String(),
+		"rank":    float64(3),
+		"user_id": float64(5),
+		"value":   float64(100),
+		"chunk":   float64(2),
+		"size":    float64(3),
+	}, body)
+
+	status, _ = do(t, handler, http.MethodGet, "/jobs/likes/users/8?period=20210311")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerUserEvents(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestServer(nil).Handler()
+	require.NoError(t, helpers.UserEventsSink(redisTest, "develop", "likes", 0, time.Minute)(ctx, []r.Event{
+		{UserID: 11, Event: r.Entered, CurrentChunk: 2},
+		{UserID: 11, Event: r.MoveUp, PreviousChunk: 2, CurrentChunk: 1},
+	}))
+	require.NoError(t, helpers.UserEventsSink(redisTest, "develop", "comments", 0, time.Minute)(ctx, []r.Event{
+		{UserID: 11, Event: r.Out, PreviousChunk: 1},
+	}))
+
+	var events []helpers.UserEvent
+	req := httptest.NewRequest(http.MethodGet, "/users/11/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	require.Len(t, events, 3)
+	require.Equal(t, "comments", events[0].Rating)
+
+	// фильтр по рейтингу и limit применяются вместе, новые события первыми
+	req = httptest.NewRequest(http.MethodGet, "/users/11/events?rating=likes&limit=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	require.Len(t, events, 1)
+	require.Equal(t, "likes", events[0].Rating)
+	require.Equal(t, 2, events[0].PreviousChunk)
+	require.Equal(t, 1, events[0].CurrentChunk)
+}
@@ -0,0 +1,98 @@
+package ratiing_filter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// BatchOptions разбиение событий на пачки для EventsProcessor
+type BatchOptions struct {
+	// Size размер пачки, 0 - все события одним вызовом
+	Size int
+	// Workers сколько пачек обрабатывается одновременно, 0 - по одной
+	Workers int
+}
+
+// BatchFailure пачка, которую не удалось обработать
+type BatchFailure struct {
+	Events []Event
+	Err    error
+}
+
+// BatchError часть пачек не обработана, остальные обработаны успешно
+type BatchError struct {
+	// Batches всего пачек
+	Batches int
+	// Total всего событий
+	Total int
+	// Processed событий в успешно обработанных пачках
+	Processed int
+	Failed    []BatchFailure
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d batches failed, %d of %d events processed, first error: %v",
+		len(e.Failed), e.Batches, e.Processed, e.Total, e.Failed[0].Err)
+}
+
+// FailedEvents события из необработанных пачек
+func (e *BatchError) FailedEvents() []Event {
+	var events []Event
+	for _, f := range e.Failed {
+		events = append(events, f.Events...)
+	}
+	return events
+}
+
+// processBatches обрабатываем события пачками ограниченным числом воркеров,
+// таймаут и политика стадии Process применяются к каждой пачке
+func (s ScopeEvent) processBatches(ctx context.Context, events []Event) error {
+	var batches [][]Event
+	for start := 0; start < len(events); start += s.Batch.Size {
+		end := start + s.Batch.Size
+		if end > len(events) {
+			end = len(events)
+		}
+		batches = append(batches, events[start:end])
+	}
+
+	workers := s.Batch.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+
+	errs := make([]error, len(batches))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = s.processBatch(ctx, batches[i])
+			}
+		}()
+	}
+	for i := range batches {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	batchErr := &BatchError{Batches: len(batches), Total: len(events)}
+	for i, err := range errs {
+		if err != nil {
+			batchErr.Failed = append(batchErr.Failed, BatchFailure{Events: batches[i], Err: err})
+			continue
+		}
+		batchErr.Processed += len(batches[i])
+	}
+	if len(batchErr.Failed) == 0 {
+		return nil
+	}
+	return batchErr
+}
@@ -0,0 +1,139 @@
+package helpers
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	r "ratings_filters/rating_filter"
+	"strconv"
+)
+
+// chunkMapSentinel служебное поле хеша: карта существует, даже когда рейтинг опустел
+const chunkMapSentinel = "_"
+
+// chunkDiffScript сравниваем карту с текущими чанками на стороне редис, ARGV - пары userID, чанк.
+// Возвращаем только отличия: пользователей, чей чанк изменился (0 - его не было в карте), и выбывших
+const chunkDiffScript = `if redis.call("EXISTS", KEYS[1]) == 0 then return false end
+local stored = redis.call("HGETALL", KEYS[1])
+local previous = {}
+for i = 1, #stored, 2 do previous[stored[i]] = stored[i + 1] end
+previous[ARGV[1]] = nil
+local diff = {}
+for i = 2, #ARGV, 2 do
+	local chunk = previous[ARGV[i]]
+	if chunk ~= ARGV[i + 1] then
+		diff[#diff + 1] = ARGV[i]
+		diff[#diff + 1] = chunk or "0"
+	end
+	previous[ARGV[i]] = nil
+end
+for userID, chunk in pairs(previous) do
+	diff[#diff + 1] = userID
+	diff[#diff + 1] = chunk
+end
+return diff`
+
+// saveChunkMapScript применяем изменения карты целиком или никак. KEYS[1] счётчик токенов блокировки, KEYS[2] хеш,
+// ARGV: токен (0 - без блокировки), ttl в мс, служебное поле, число изменённых n, n пар userID, чанк, выбывшие
+const saveChunkMapScript = fenceCheck + `
+local n = tonumber(ARGV[4])
+redis.call("HSET", KEYS[2], ARGV[3], 1)
+for i = 5, 4 + n * 2, 2 do redis.call("HSET", KEYS[2], ARGV[i], ARGV[i + 1]) end
+for i = 5 + n * 2, #ARGV do redis.call("HDEL", KEYS[2], ARGV[i]) end
+if tonumber(ARGV[2]) > 0 then redis.call("PEXPIRE", KEYS[2], ARGV[2]) end
+return 1`
+
+// GetChunkMap читаем всю карту userID -> чанк рейтинга key, для просмотра снапшота
+func GetChunkMap(ctx context.Context, pool redis.Pool, key RatingKey) (map[uint32]int, error) {
+	err := key.Validate()
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.StringMap(doContext(ctx, pool, "HGETALL", key.ChunksKey()))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot fetch chunks")
+	}
+	if len(values) == 0 {
+		return nil, r.ErrNotFound
+	}
+	delete(values, chunkMapSentinel)
+	return parseChunks(values)
+}
+
+// GetPreviousChunks предыдущие чанки рейтинга key для запуска с текущими чанками current.
+// По сети приходят только отличия от current, остальные пользователи остались в своих чанках
+func GetPreviousChunks(ctx context.Context, pool redis.Pool, key RatingKey, current map[uint32]int) (map[uint32]int, error) {
+	err := key.Validate()
+	if err != nil {
+		return nil, err
+	}
+	args := redis.Args{}.Add(chunkDiffScript, 1, key.ChunksKey(), chunkMapSentinel)
+	for userID, chunk := range current {
+		args = args.Add(userID, chunk)
+	}
+	values, err := redis.Strings(doContext(ctx, pool, "EVAL", args...))
+	if err == redis.ErrNil {
+		return nil, r.ErrNotFound
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "cannot fetch chunks")
+	}
+
+	diff := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		diff[values[i]] = values[i+1]
+	}
+	changed, err := parseChunks(diff)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[uint32]int, len(current))
+	for userID, chunk := range current {
+		previous[userID] = chunk
+	}
+	for userID, chunk := range changed {
+		if chunk == 0 {
+			delete(previous, userID)
+			continue
+		}
+		previous[userID] = chunk
+	}
+	return previous, nil
+}
+
+func parseChunks(values map[string]string) (map[uint32]int, error) {
+	chunks := make(map[uint32]int, len(values))
+	for field, value := range values {
+		userID, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "cannot parse chunks field %q", field)
+		}
+		chunk, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "cannot parse chunk of user %d", userID)
+		}
+		chunks[uint32(userID)] = chunk
+	}
+	return chunks, nil
+}
+
+// SaveChunkMap пишем в хеш только изменившихся пользователей и удаляем выбывших одним EVAL,
+// чтобы сбой посередине не оставил смешанную карту. Из opts используется только TTL.
+// Запись под блокировкой отвергается с ErrStaleToken, если блокировку уже взял более новый запуск
+func SaveChunkMap(ctx context.Context, pool redis.Pool, key RatingKey, changed map[uint32]int, removed []uint32, opts SnapshotOptions) error {
+	err := key.Validate()
+	if err != nil {
+		return err
+	}
+	token, _ := r.FencingToken(ctx)
+	args := redis.Args{}.Add(saveChunkMapScript, 2, fenceKey(key.LockKey()), key.ChunksKey()).
+		Add(token, opts.TTL.Milliseconds(), chunkMapSentinel, len(changed))
+	for userID, chunk := range changed {
+		args = args.Add(userID, chunk)
+	}
+	args = args.AddFlat(removed)
+	_, err = doContext(ctx, pool, "EVAL", args...)
+	if err != nil {
+		return errors.WithMessage(staleToken(err), "cannot save chunks")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package ratiing_filter
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/pkg/errors"
+)
+
+// getChunkEvent события по сохранённой карте чанков, сохраняем только изменения
+func getChunkEvent(ctx context.Context, report *EventReport, scope ScopeEvent) error {
+	current := report.CurrentChunks
+
+	previous, err := scope.fetchChunks(ctx, current)
+	if errors.Cause(err) == ErrNotFound {
+		if scope.DryRun {
+			return nil
+		}
+		err = scope.saveChunks(ctx, current, nil)
+		if err != nil {
+			return errors.WithMessage(err, "cannot save chunks")
+		}
+		return nil
+	} else if err != nil {
+		return errors.WithMessage(err, "cannot fetch chunks")
+	}
+
+	report.PreviousChunks = previous
+	err = scope.buildEvents(ctx, report)
+	if err != nil {
+		return err
+	}
+	if scope.DryRun {
+		return nil
+	}
+	save, processErr := scope.handleEvents(ctx, report.Events)
+	if !save {
+		return processErr
+	}
+
+	changed, removed := diffChunks(current, previous)
+	err = scope.saveChunks(ctx, changed, removed)
+	if err != nil {
+		return stderrors.Join(processErr, errors.WithMessage(err, "cannot save chunks"))
+	}
+
+	err = scope.savePending(ctx, report.Pending)
+	if err != nil {
+		return stderrors.Join(processErr, err)
+	}
+
+	return processErr
+}
+
+// diffChunks пользователи, у которых чанк изменился или появился, и выбывшие из рейтинга
+func diffChunks(current, previous map[uint32]int) (changed map[uint32]int, removed []uint32) {
+	changed = make(map[uint32]int)
+	for userID, chunk := range current {
+		if previousChunk, ok := previous[userID]; !ok || previousChunk != chunk {
+			changed[userID] = chunk
+		}
+	}
+	for userID := range previous {
+		if _, ok := current[userID]; !ok {
+			removed = append(removed, userID)
+		}
+	}
+	return changed, removed
+}
@@ -0,0 +1,405 @@
+// ratingctl запускает задания рейтингов из конфига и показывает их снапшоты
+//
+//	ratingctl events -config ratings.json -job likes -dry-run
+//	ratingctl rewards -config ratings.json -job likes -json
+//	ratingctl snapshot show -config ratings.json -job likes -period 20210310
+//	ratingctl snapshot diff -config ratings.json -job likes -from 20210309 -to 20210310
+//	ratingctl dict validate -config ratings.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"os/signal"
+	"ratings_filters/helpers"
+	"ratings_filters/jobs"
+	r "ratings_filters/rating_filter"
+	"sort"
+	"time"
+)
+
+const usage = `usage: ratingctl <command> [flags]
+
+commands:
+  events          compute rating events and send them to the job sinks
+  rewards         compute rewards of the current rating
+  snapshot show   print the stored snapshot
+  snapshot diff   print events between two stored snapshots
+  dict validate   load and check reward dictionaries
+
+run "ratingctl <command> -h" for command flags`
+
+func main() {
+	log.SetFlags(0)
+	commands := map[string]func(args []string) error{
+		"events":        runEvents,
+		"rewards":       runRewards,
+		"snapshot show": runSnapshotShow,
+		"snapshot diff": runSnapshotDiff,
+		"dict validate": runDictValidate,
+	}
+
+	args := os.Args[1:]
+	var run func(args []string) error
+	if len(args) > 0 {
+		run = commands[args[0]]
+		args = args[1:]
+	}
+	if run == nil && len(os.Args) > 2 {
+		run = commands[os.Args[1]+" "+os.Args[2]]
+		args = os.Args[3:]
+	}
+	if run == nil {
+		log.Fatal(usage)
+	}
+
+	err := run(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// options флаги, общие для всех команд
+type options struct {
+	config string
+	job    string
+	json   bool
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	opts := &options{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.config, "config", "ratings.json", "jobs config file")
+	fs.StringVar(&opts.job, "job", "", "job name from the config")
+	fs.BoolVar(&opts.json, "json", false, "print JSON instead of text")
+	return fs, opts
+}
+
+func (o *options) load() (*jobs.Config, jobs.JobConfig, error) {
+	cfg, err := jobs.LoadConfig(o.config)
+	if err != nil {
+		return nil, jobs.JobConfig{}, err
+	}
+	job, err := cfg.Job(o.job)
+	if err != nil {
+		return nil, jobs.JobConfig{}, err
+	}
+	return cfg, job, nil
+}
+
+// key ключ снапшота задания, period переопределяет текущий период
+func key(cfg *jobs.Config, job jobs.JobConfig, period string) helpers.RatingKey {
+	key := cfg.Key(job, time.Now())
+	if period != "" {
+		key.Period = period
+	}
+	return key
+}
+
+func runEvents(args []string) error {
+	fs, opts := newFlagSet("events")
+	dryRun := fs.Bool("dry-run", false, "compute events without saving the snapshot and calling sinks")
+	period := fs.String("period", "", "snapshot period, defaults to the current one")
+	_ = fs.Parse(args)
+
+	cfg, job, err := opts.load()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	deps, closeDeps, err := jobs.Connect(ctx, cfg)
+	defer closeDeps()
+	if err != nil {
+		return err
+	}
+
+	scope, err := jobs.EventScope(job, key(cfg, job, *period), deps)
+	if err != nil {
+		return err
+	}
+	scope.DryRun = *dryRun
+
+	source, err := jobs.Source(job, deps)
+	if err != nil {
+		return err
+	}
+	report, err := r.GetEventFromSource(ctx, source, scope)
+	if err != nil {
+		return err
+	}
+	return printRows(opts.json, eventViews(report.Events))
+}
+
+func runRewards(args []string) error {
+	fs, opts := newFlagSet("rewards")
+	_ = fs.Parse(args)
+
+	cfg, job, err := opts.load()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	deps, closeDeps, err := jobs.Connect(ctx, cfg)
+	defer closeDeps()
+	if err != nil {
+		return err
+	}
+
+	scope, err := jobs.RewardScope(job, deps)
+	if err != nil {
+		return err
+	}
+	source, err := jobs.Source(job, deps)
+	if err != nil {
+		return err
+	}
+	rating, err := source.GetRating(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "cannot get current rating")
+	}
+
+	var rows []rewardView
+	for _, rew := range r.Rewards(rating, scope) {
+		rows = append(rows, rewardView{UserID: rew.UserID, FactorRuby: rew.FactorRuby, FactorVIP: rew.FactorVIP})
+	}
+	return printRows(opts.json, rows)
+}
+
+func runSnapshotShow(args []string) error {
+	fs, opts := newFlagSet("snapshot show")
+	period := fs.String("period", "", "snapshot period, defaults to the current one")
+	_ = fs.Parse(args)
+
+	cfg, job, err := opts.load()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	deps, closeDeps, err := jobs.Connect(ctx, cfg)
+	defer closeDeps()
+	if err != nil {
+		return err
+	}
+
+	k := key(cfg, job, *period)
+	if job.Store.ChunkMap {
+		chunks, err := helpers.GetChunkMap(ctx, deps.Redis, k)
+		if err != nil {
+			return errors.WithMessagef(err, "snapshot %s", k)
+		}
+		return printRows(opts.json, chunkViews(chunks))
+	}
+
+	rating, err := helpers.GetPreviousRating(ctx, deps.Redis, k)
+	if err != nil {
+		return errors.WithMessagef(err, "snapshot %s", k)
+	}
+	var rows []itemView
+	for _, item := range rating {
+		rows = append(rows, itemView{Rank: item.GetRank(), UserID: item.GetUserID(), Value: item.GetValue()})
+	}
+	return printRows(opts.json, rows)
+}
+
+func runSnapshotDiff(args []string) error {
+	fs, opts := newFlagSet("snapshot diff")
+	from := fs.String("from", "", "older snapshot period")
+	to := fs.String("to", "", "newer snapshot period, defaults to the current one")
+	_ = fs.Parse(args)
+	if *from == "" {
+		return errors.New("-from is required")
+	}
+
+	cfg, job, err := opts.load()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	deps, closeDeps, err := jobs.Connect(ctx, cfg)
+	defer closeDeps()
+	if err != nil {
+		return err
+	}
+
+	previous, err := loadChunks(ctx, deps, job, key(cfg, job, *from))
+	if err != nil {
+		return err
+	}
+	current, err := loadChunks(ctx, deps, job, key(cfg, job, *to))
+	if err != nil {
+		return err
+	}
+	return printRows(opts.json, eventViews(r.CompareChunks(current, previous)))
+}
+
+// loadChunks карта чанков снапшота, полный снапшот делится на чанки задания
+func loadChunks(ctx context.Context, deps jobs.Deps, job jobs.JobConfig, k helpers.RatingKey) (map[uint32]int, error) {
+	if job.Store.ChunkMap {
+		chunks, err := helpers.GetChunkMap(ctx, deps.Redis, k)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "snapshot %s", k)
+		}
+		return chunks, nil
+	}
+	rating, err := helpers.GetPreviousRating(ctx, deps.Redis, k)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "snapshot %s", k)
+	}
+	return r.RatingChunks(rating, job.Chunks), nil
+}
+
+func runDictValidate(args []string) error {
+	fs, opts := newFlagSet("dict validate")
+	_ = fs.Parse(args)
+
+	cfg, err := jobs.LoadConfig(opts.config)
+	if err != nil {
+		return err
+	}
+	selected := cfg.Jobs
+	if opts.job != "" {
+		job, err := cfg.Job(opts.job)
+		if err != nil {
+			return err
+		}
+		selected = []jobs.JobConfig{job}
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	deps, closeDeps, err := jobs.Connect(ctx, cfg)
+	defer closeDeps()
+	if err != nil {
+		return err
+	}
+
+	var rows []dictView
+	invalid := 0
+	for _, job := range selected {
+		if job.Rewards == "" {
+			continue
+		}
+		row := dictView{Job: job.Name, Table: job.Rewards}
+		_, err := jobs.Dict(job, deps)
+		if err != nil {
+			row.Error = err.Error()
+			invalid++
+		}
+		rows = append(rows, row)
+	}
+	err = printRows(opts.json, rows)
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return errors.Errorf("%d invalid reward dictionaries", invalid)
+	}
+	return nil
+}
+
+// printRows печатает строки текстом или одним JSON массивом
+func printRows[T fmt.Stringer](asJSON bool, rows []T) error {
+	if asJSON {
+		if rows == nil {
+			rows = []T{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	for _, row := range rows {
+		fmt.Println(row)
+	}
+	return nil
+}
+
+type eventView struct {
+	UserID        uint32 `json:"user_id"`
+	Event         string `json:"event"`
+	PreviousChunk int    `json:"previous_chunk"`
+	CurrentChunk  int    `json:"current_chunk"`
+}
+
+func (v eventView) String() string {
+	return fmt.Sprintf("%d\t%s\t%d -> %d", v.UserID, v.Event, v.PreviousChunk, v.CurrentChunk)
+}
+
+func eventViews(events []r.Event) []eventView {
+	rows := make([]eventView, 0, len(events))
+	for _, e := range events {
+		rows = append(rows, eventView{
+			UserID:        e.UserID,
+			Event:         r.EventName(e.Event),
+			PreviousChunk: e.PreviousChunk,
+			CurrentChunk:  e.CurrentChunk,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].UserID < rows[j].UserID
+	})
+	return rows
+}
+
+type rewardView struct {
+	UserID     uint32 `json:"user_id"`
+	FactorRuby int64  `json:"factor_ruby"`
+	FactorVIP  int64  `json:"factor_vip"`
+}
+
+func (v rewardView) String() string {
+	return fmt.Sprintf("%d\truby x%d\tvip x%d", v.UserID, v.FactorRuby, v.FactorVIP)
+}
+
+type itemView struct {
+	Rank   uint32 `json:"rank"`
+	UserID uint32 `json:"user_id"`
+	Value  int64  `json:"value"`
+}
+
+func (v itemView) String() string {
+	return fmt.Sprintf("%d\t%d\t%d", v.Rank, v.UserID, v.Value)
+}
+
+type chunkView struct {
+	UserID uint32 `json:"user_id"`
+	Chunk  int    `json:"chunk"`
+}
+
+func (v chunkView) String() string {
+	return fmt.Sprintf("%d\t%d", v.UserID, v.Chunk)
+}
+
+func chunkViews(chunks map[uint32]int) []chunkView {
+	rows := make([]chunkView, 0, len(chunks))
+	for userID, chunk := range chunks {
+		rows = append(rows, chunkView{UserID: userID, Chunk: chunk})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Chunk != rows[j].Chunk {
+			return rows[i].Chunk < rows[j].Chunk
+		}
+		return rows[i].UserID < rows[j].UserID
+	})
+	return rows
+}
+
+type dictView struct {
+	Job   string `json:"job"`
+	Table string `json:"table"`
+	Error string `json:"error,omitempty"`
+}
+
+func (v dictView) String() string {
+	if v.Error != "" {
+		return fmt.Sprintf("%s\t%s\t%s", v.Job, v.Table, v.Error)
+	}
+	return fmt.Sprintf("%s\t%s\tok", v.Job, v.Table)
+}
@@ -0,0 +1,145 @@
+// ratingd запускает задания рейтингов из конфига по их расписаниям
+//
+//	ratingd -config ratings.json -metrics :9100 -admin :8080 -log-format json
+//
+// токен админки задаётся переменной окружения RATINGD_ADMIN_TOKEN, без него с -admin ratingd не запускается
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"ratings_filters/admin"
+	"ratings_filters/jobs"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var (
+		config    = flag.String("config", "ratings.json", "jobs config file")
+		shutdown  = flag.Duration("shutdown-timeout", time.Minute, "how long to wait for running jobs on exit")
+		metrics   = flag.String("metrics", "", "address to serve /metrics on, empty to disable")
+		adminAddr = flag.String("admin", "", "address to serve the admin API on, empty to disable")
+		logLevel  = flag.String("log-level", "info", "debug, info, warn or error")
+		logFormat = flag.String("log-format", "text", "text or json")
+	)
+	flag.Parse()
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		slog.Error("cannot create logger", "error", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	err = run(*config, *metrics, *adminAddr, *shutdown, logger)
+	if err != nil {
+		logger.Error("ratingd stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(config, metrics, adminAddr string, shutdown time.Duration, logger *slog.Logger) error {
+	adminToken := os.Getenv("RATINGD_ADMIN_TOKEN")
+	if adminAddr != "" && adminToken == "" {
+		return errors.New("admin API requires RATINGD_ADMIN_TOKEN")
+	}
+	cfg, err := jobs.LoadConfig(config)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	deps, closeDeps, err := jobs.Connect(ctx, cfg)
+	defer closeDeps()
+	if err != nil {
+		return err
+	}
+	deps.Logger = logger
+	scheduler, err := jobs.NewScheduler(cfg, deps)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 2)
+	var servers []*http.Server
+	serve := func(name, addr string, handler http.Handler) {
+		server := newHTTPServer(addr, handler)
+		servers = append(servers, server)
+		go func() {
+			err := server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				serveErr <- errors.WithMessage(err, name)
+			}
+		}()
+	}
+	if metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		serve("metrics server", metrics, mux)
+	}
+	if adminAddr != "" {
+		server := &admin.Server{
+			Config:  cfg,
+			Deps:    deps,
+			Trigger: scheduler.Trigger,
+			Token:   adminToken,
+		}
+		serve("admin server", adminAddr, server.Handler())
+	}
+
+	scheduler.Start(context.Background())
+	logger.Info("ratingd started", "jobs", len(cfg.Jobs), "metrics", metrics, "admin", adminAddr)
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-serveErr:
+	}
+
+	logger.Info("stopping, waiting for running jobs", "timeout", shutdown)
+	stopCtx, cancel := context.WithTimeout(context.Background(), shutdown)
+	defer cancel()
+	// сначала закрываем серверы, чтобы админка не запускала новые задания, пока ждём текущие
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(stopCtx); shutdownErr != nil {
+			logger.Warn("cannot shut down http server", "addr", server.Addr, "error", shutdownErr)
+		}
+	}
+	scheduler.Stop(stopCtx)
+	return err
+}
+
+// newHTTPServer сервер с таймаутами, чтобы медленные клиенты не держали соединения бесконечно
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse log level")
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, errors.Errorf("unknown log format %q", format)
+}
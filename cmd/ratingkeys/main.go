@@ -0,0 +1,58 @@
+// ratingkeys перечисляет ключи снапшотов рейтингов и удаляет устаревшие
+//
+//	ratingkeys -redis localhost:6379 -env develop
+//	ratingkeys -redis localhost:6379 -env develop -name likes -before 20210301 -delete
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"ratings_filters/helpers"
+)
+
+func main() {
+	var (
+		addr     = flag.String("redis", "localhost:6379", "redis address")
+		password = flag.String("password", "", "redis password")
+		env      = flag.String("env", "", "environment, empty for all")
+		name     = flag.String("name", "", "rating name, empty for all")
+		before   = flag.String("before", "", "list keys with period before this one as stale, daily 20210310 or weekly 2021W10")
+		remove   = flag.Bool("delete", false, "delete stale keys, requires -before")
+	)
+	flag.Parse()
+
+	pool := redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", *addr, redis.DialPassword(*password))
+		},
+	}
+	pattern := helpers.RatingKeyPattern(*env, *name)
+
+	if *before == "" {
+		if *remove {
+			log.Fatal("-delete requires -before")
+		}
+		keys, err := helpers.ListRatingKeys(context.Background(), pool, pattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return
+	}
+
+	stale, err := helpers.CleanupRatingKeys(context.Background(), pool, pattern, *before, !*remove)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, key := range stale {
+		fmt.Println(key)
+	}
+	if !*remove {
+		fmt.Printf("%d stale keys, run with -delete to remove them\n", len(stale))
+	}
+}
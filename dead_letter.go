@@ -0,0 +1,72 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	r "ratings_filters/rating_filter"
+	"time"
+)
+
+// DeadLetter события, которые не удалось обработать
+type DeadLetter struct {
+	Time   time.Time
+	Error  string
+	Events []r.Event
+}
+
+// SaveDeadLetters кладём необработанные события в конец списка редис для повторной обработки,
+// подходит как ScopeEvent.DeadLetter
+func SaveDeadLetters(ctx context.Context, pool redis.Pool, key RatingKey, events []r.Event, cause error) error {
+	err := key.Validate()
+	if err != nil {
+		return err
+	}
+	letter := DeadLetter{Time: time.Now(), Events: events}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return errors.WithMessage(err, "cannot marshal dead letter")
+	}
+	_, err = doContext(ctx, pool, "RPUSH", key.DeadLetterKey(), b)
+	if err != nil {
+		return errors.WithMessage(err, "cannot save dead letter")
+	}
+	return nil
+}
+
+// ReplayDeadLetters отдаём записи processor по порядку, запись удаляется только после успешной обработки,
+// на первой ошибке останавливаемся; одновременный replay одного ключа не поддерживается
+func ReplayDeadLetters(ctx context.Context, pool redis.Pool, key RatingKey, processor func(ctx context.Context, e []r.Event) error) (replayed int, err error) {
+	err = key.Validate()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		b, err := redis.Bytes(doContext(ctx, pool, "LINDEX", key.DeadLetterKey(), 0))
+		if err == redis.ErrNil {
+			return replayed, nil
+		} else if err != nil {
+			return replayed, errors.WithMessage(err, "cannot fetch dead letter")
+		}
+
+		var letter DeadLetter
+		err = json.Unmarshal(b, &letter)
+		if err != nil {
+			return replayed, errors.WithMessage(err, "cannot unmarshal dead letter")
+		}
+		err = processor(ctx, letter.Events)
+		if err != nil {
+			return replayed, errors.WithMessage(err, "cannot process dead letter")
+		}
+
+		_, err = doContext(ctx, pool, "LPOP", key.DeadLetterKey())
+		if err != nil {
+			return replayed, errors.WithMessage(err, "cannot remove dead letter")
+		}
+		replayed++
+	}
+}
@@ -3,22 +3,46 @@ package helpers
 import (
 	"database/sql"
 	"encoding/json"
+	stderrors "errors"
 	"github.com/golang/protobuf/proto"
-	pc "proto-compile"
+	"github.com/pkg/errors"
 	"mysql"
+	pc "proto-compile"
+	"time"
+)
+
+// типы полос наград, тип задаётся полем Band в Data, по умолчанию место
+const (
+	// bandPlace Place - верхняя граница места
+	bandPlace = "place"
+	// bandPercent Place - верхняя граница в процентах от размера рейтинга (топ N%)
+	bandPercent = "percent"
+	// bandScore Place - минимальное значение RatingItem.Value
+	bandScore = "score"
 )
 
+// bandPriority порядок проверки полос: места, затем проценты, затем пороги очков
+var bandPriority = []string{bandPlace, bandPercent, bandScore}
+
 type dictPayerRatings struct {
 	rewards []*reward
 }
 
 type reward struct {
-	lBoundPlace int
-	uBoundPlace int
+	band string
+	// границы полосы, для места включительно, для процентов нижняя граница не включается,
+	// для порогов используется только uBound
+	lBound int
+	uBound int
 	*pc.AdmTalkDictPayerRatingData
 }
 
+type rewardBand struct {
+	Band string `json:"Band"`
+}
+
 func NewDictPayerRatings(sqlPool *mysql.ConnectionsPool, tableName string) (payerRatings *dictPayerRatings, err error) {
+	defer observeStorage(storeMySQL, "select_dict", time.Now(), &err)
 	payerRatings = new(dictPayerRatings)
 
 	q := "SELECT Place, Data FROM " + tableName + " WHERE Enabled = 1 ORDER BY Place"
@@ -29,7 +53,7 @@ func NewDictPayerRatings(sqlPool *mysql.ConnectionsPool, tableName string) (paye
 			}
 			var data string
 			factors := &pc.AdmTalkDictPayerRatingData{}
-			err := rows.Scan(&item.uBoundPlace, &data)
+			err := rows.Scan(&item.uBound, &data)
 			if err != nil {
 				return err
 			}
@@ -37,6 +61,15 @@ func NewDictPayerRatings(sqlPool *mysql.ConnectionsPool, tableName string) (paye
 			if err != nil {
 				return err
 			}
+			band := rewardBand{}
+			err = json.Unmarshal([]byte(data), &band)
+			if err != nil {
+				return err
+			}
+			item.band, err = parseBand(band.Band)
+			if err != nil {
+				return err
+			}
 
 			item.FactorRuby = factors.FactorRuby
 			item.FactorVIP = factors.FactorVIP
@@ -47,32 +80,134 @@ func NewDictPayerRatings(sqlPool *mysql.ConnectionsPool, tableName string) (paye
 		return nil, err
 	}
 
-	// нижняя граница
-	for i, item := range payerRatings.rewards {
-		if i == 0 {
-			item.lBoundPlace = 1
-		} else {
-			item.lBoundPlace = payerRatings.rewards[i-1].uBoundPlace + 1
+	// нижняя граница считается отдельно для каждого типа полос
+	previous := make(map[string]*reward)
+	for _, item := range payerRatings.rewards {
+		prev, ok := previous[item.band]
+		switch {
+		case item.band == bandPercent && !ok:
+			item.lBound = 0
+		case ok:
+			item.lBound = prev.uBound
+			if item.band == bandPlace {
+				item.lBound++
+			}
+		default:
+			item.lBound = 1
 		}
+		previous[item.band] = item
 	}
 
 	return
 }
 
-func (d *dictPayerRatings) GetReward(place int) *pc.AdmTalkDictPayerRatingData {
-	r := &pc.AdmTalkDictPayerRatingData{}
-	for _, item := range d.rewards {
-		if place >= item.lBoundPlace && place <= item.uBoundPlace {
-			r = &pc.AdmTalkDictPayerRatingData{
+func parseBand(band string) (string, error) {
+	switch band {
+	case "", bandPlace:
+		return bandPlace, nil
+	case bandPercent, bandScore:
+		return band, nil
+	}
+	return "", errors.Errorf("unknown reward band %q", band)
+}
+
+func (d *dictPayerRatings) GetReward(place, ratingSize int, value int64) *pc.AdmTalkDictPayerRatingData {
+	for _, band := range bandPriority {
+		item := d.match(band, place, ratingSize, value)
+		if item != nil {
+			return &pc.AdmTalkDictPayerRatingData{
 				FactorRuby: item.FactorRuby,
 				FactorVIP:  item.FactorVIP,
 			}
-		} else {
-			r = &pc.AdmTalkDictPayerRatingData{
-				FactorRuby: proto.Int64(0),
-				FactorVIP:  proto.Int64(0),
+		}
+	}
+	return &pc.AdmTalkDictPayerRatingData{
+		FactorRuby: proto.Int64(0),
+		FactorVIP:  proto.Int64(0),
+	}
+}
+
+// match ищет полосу заданного типа, в которую попадает пользователь
+func (d *dictPayerRatings) match(band string, place, ratingSize int, value int64) *reward {
+	var matched *reward
+	for _, item := range d.rewards {
+		if item.band != band {
+			continue
+		}
+		switch band {
+		case bandPlace:
+			if place >= item.lBound && place <= item.uBound {
+				return item
+			}
+		case bandPercent:
+			if ratingSize <= 0 {
+				return nil
+			}
+			percent := float64(place) * 100 / float64(ratingSize)
+			if percent > float64(item.lBound) && percent <= float64(item.uBound) {
+				return item
+			}
+		case bandScore:
+			// пороги отсортированы по возрастанию, берём наибольший пройденный
+			if value >= int64(item.uBound) {
+				matched = item
+			}
+		}
+	}
+	return matched
+}
+
+// Validate проверяет словарь целиком и возвращает все найденные проблемы сразу
+func (d *dictPayerRatings) Validate() error {
+	if len(d.rewards) == 0 {
+		return errors.New("reward dictionary is empty")
+	}
+	var errs []error
+	thresholds := make(map[int]bool)
+	for _, item := range d.rewards {
+		switch item.band {
+		case bandPlace:
+			if item.uBound < item.lBound {
+				errs = append(errs, errors.Errorf("place band %d-%d is empty or duplicated", item.lBound, item.uBound))
+			}
+		case bandPercent:
+			if item.uBound <= item.lBound || item.uBound > 100 {
+				errs = append(errs, errors.Errorf("percent band %d-%d is empty or out of range", item.lBound, item.uBound))
+			}
+		case bandScore:
+			if thresholds[item.uBound] {
+				errs = append(errs, errors.Errorf("score threshold %d is duplicated", item.uBound))
 			}
+			thresholds[item.uBound] = true
 		}
+		if item.GetFactorRuby() < 0 || item.GetFactorVIP() < 0 {
+			errs = append(errs, errors.Errorf("%s band ending at %d has negative factor", item.band, item.uBound))
+		}
+	}
+	return stderrors.Join(errs...)
+}
+
+// RewardBand полоса словаря наград в том виде, в каком её показывают людям
+type RewardBand struct {
+	Band string `json:"band"`
+	// From и To границы полосы как в match, для порогов очков From не используется
+	From       int   `json:"from"`
+	To         int   `json:"to"`
+	FactorRuby int64 `json:"factor_ruby"`
+	FactorVIP  int64 `json:"factor_vip"`
+}
+
+// Bands содержимое словаря в порядке загрузки
+func (d *dictPayerRatings) Bands() []RewardBand {
+	bands := make([]RewardBand, 0, len(d.rewards))
+	for _, item := range d.rewards {
+		bands = append(bands, RewardBand{
+			Band:       item.band,
+			From:       item.lBound,
+			To:         item.uBound,
+			FactorRuby: item.GetFactorRuby(),
+			FactorVIP:  item.GetFactorVIP(),
+		})
 	}
-	return r
+	return bands
 }
@@ -1,64 +1,261 @@
 package ratiing_filter
 
 import (
-	"fmt"
+	"context"
+	stderrors "errors"
 	"github.com/pkg/errors"
+	"log/slog"
 	approto "proto"
 	"ratings_filters/interfaces"
+	"time"
 )
 
+// ScopeEvent callbacks обязаны уважать ctx: по таймауту стадии ctx отменяется,
+// но стадию дожидаются, прежде чем идти дальше
 type ScopeEvent struct {
-	EventsProcessor func(e []Event) error
-	RatingFetcher   func() ([]*approto.RatingItem, error)
-	RatingSaver     func(item []*approto.RatingItem) error
+	// Name имя рейтинга в метриках
+	Name            string
+	EventsProcessor func(ctx context.Context, e []Event) error
+	RatingFetcher   func(ctx context.Context) ([]*approto.RatingItem, error)
+	RatingSaver     func(ctx context.Context, item []*approto.RatingItem) error
 	RatingFilter    func(item *approto.RatingItem) bool
 	Chunks          [][2]int
+	// ChunkFetcher и ChunkSaver включают хранение только карты userID -> чанк вместо всего рейтинга,
+	// RatingFetcher и RatingSaver тогда не используются. ChunkFetcher получает текущие чанки,
+	// чтобы хранилище могло отдать только отличия от них, но возвращает всю предыдущую карту
+	ChunkFetcher func(ctx context.Context, current map[uint32]int) (map[uint32]int, error)
+	ChunkSaver   func(ctx context.Context, changed map[uint32]int, removed []uint32) error
+	Timeouts     StageTimeouts
+	// Policies повторы и предохранители стадий, ошибки стадий тогда оборачиваются в *RetryError
+	Policies StagePolicies
+	// OnProcessError что делать со снапшотом при ошибке EventsProcessor, по умолчанию не сохраняем
+	OnProcessError ProcessFailurePolicy
+	// DeadLetter хранилище необработанных событий для DeadLetterOnProcessError
+	DeadLetter func(ctx context.Context, events []Event, cause error) error
+	// Batch обработка событий пачками, при частичной неудаче ошибка содержит *BatchError
+	Batch BatchOptions
+	// Hysteresis подавление дребезга у границ чанков, неподтверждённые переходы
+	// читаются PendingFetcher и сохраняются PendingSaver вместе со снапшотом
+	Hysteresis     *Hysteresis
+	PendingFetcher func(ctx context.Context) (map[uint32]PendingChange, error)
+	PendingSaver   func(ctx context.Context, pending map[uint32]PendingChange) error
+	// DryRun считаем события без сохранения снапшота и вызова EventsProcessor, результат в EventReport
+	DryRun bool
+	// Locker не даёт двум запускам обрабатывать LockKey одновременно, при DryRun не используется
+	Locker  Locker
+	LockKey string
+	// Logger к строкам добавляются run_id и rating, nil - slog.Default()
+	Logger *slog.Logger
 }
 type ScopeDislikeReward struct {
+	// Name имя рейтинга в метриках
+	Name         string
 	RatingFilter func(item *approto.RatingItem) bool
 	PayerRatings interfaces.PayerRatingsDict
+	// RewardsProcessor выплата наград, nil - только считаем
+	RewardsProcessor func(ctx context.Context, rewards []*RewardUser) error
+	// DryRun не вызываем RewardsProcessor, результат в RewardReport
+	DryRun bool
+	// Logger к строкам добавляются run_id и rating, nil - slog.Default()
+	Logger *slog.Logger
 }
 
 var (
 	ErrNotFound = errors.New("not found")
 )
 
-func GetEvent(currentRating []*approto.RatingItem, scope ScopeEvent) error {
-	filteredRating := filterRating(currentRating, scope.RatingFilter)
+func GetEvent(ctx context.Context, currentRating []*approto.RatingItem, scope ScopeEvent) (*EventReport, error) {
+	started := time.Now()
+	ctx, runID := ensureRunID(ctx)
+	scope.Logger = runLogger(scope.Logger, runID, scope.Name)
+	ctx, span := tracer.Start(ctx, "GetEvent")
 
-	previousRating, err := scope.RatingFetcher()
-	if err == ErrNotFound {
-		err = scope.RatingSaver(filteredRating)
+	report, err := getLockedEvent(ctx, currentRating, scope)
+	if !scope.DryRun {
+		observeEventRun(scope.Name, started, currentRating, len(scope.Chunks), report, err)
+	}
+
+	attrs := []any{"dry_run", scope.DryRun, "size", len(currentRating), "duration", time.Since(started)}
+	if report != nil {
+		attrs = append(attrs, "filtered", len(currentRating)-len(report.FilteredRating), "events", len(report.Events), "pending", len(report.Pending))
+	}
+	if err != nil {
+		scope.Logger.ErrorContext(ctx, "events run failed", append(attrs, "error", err)...)
+	} else {
+		scope.Logger.InfoContext(ctx, "events run finished", attrs...)
+	}
+	endSpan(span, err, append(attrs, "name", scope.Name, "run_id", runID)...)
+	return report, err
+}
+
+// validate настройки scope, которые нельзя молча проигнорировать
+func (s ScopeEvent) validate() error {
+	err := s.Policies.validate()
+	if err != nil {
+		return err
+	}
+	return s.validateHysteresis()
+}
+
+// getLockedEvent getEvent под блокировкой scope.Locker
+func getLockedEvent(ctx context.Context, currentRating []*approto.RatingItem, scope ScopeEvent) (*EventReport, error) {
+	err := scope.validate()
+	if err != nil {
+		return nil, err
+	}
+	if scope.Locker == nil || scope.DryRun {
+		return getEvent(ctx, currentRating, scope)
+	}
+
+	lock, err := scope.Locker.Lock(ctx, scope.LockKey)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot lock %s", scope.LockKey)
+	}
+	lockCtx, cancel := lockContext(ctx, lock)
+	report, err := getEvent(lockCtx, currentRating, scope)
+	if err != nil && context.Cause(lockCtx) == ErrLockLost {
+		err = stderrors.Join(ErrLockLost, err)
+	}
+	cancel()
+
+	// снимаем блокировку даже после отмены ctx
+	unlockCtx, cancelUnlock := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancelUnlock()
+	unlockErr := lock.Unlock(unlockCtx)
+	if unlockErr != nil {
+		return report, stderrors.Join(err, errors.WithMessagef(unlockErr, "cannot unlock %s", scope.LockKey))
+	}
+	return report, err
+}
+
+func getEvent(ctx context.Context, currentRating []*approto.RatingItem, scope ScopeEvent) (*EventReport, error) {
+	report := &EventReport{
+		DryRun:         scope.DryRun,
+		FilteredRating: filterStage(ctx, scope.Logger, currentRating, scope.RatingFilter),
+	}
+	report.CurrentChunks = scope.convertChunks(ctx, report.FilteredRating)
+	if scope.ChunkFetcher != nil {
+		return report, getChunkEvent(ctx, report, scope)
+	}
+
+	previousRating, err := scope.fetchRating(ctx)
+	if errors.Cause(err) == ErrNotFound {
+		if scope.DryRun {
+			return report, nil
+		}
+		err = scope.saveRating(ctx, report.FilteredRating)
 		if err != nil {
-			return errors.WithMessage(err, "cannot save rating")
+			return report, errors.WithMessage(err, "cannot save rating")
 		}
-		return nil
+		return report, nil
 	} else if err != nil {
-		return errors.WithMessage(err, "cannot fetch rating")
+		return report, errors.WithMessage(err, "cannot fetch rating")
 	}
 
-	events := createEvents(convertRatingToChucks(filteredRating, scope.Chunks), convertRatingToChucks(previousRating, scope.Chunks))
-	err = scope.EventsProcessor(events)
+	report.PreviousChunks = scope.convertChunks(ctx, previousRating)
+	err = scope.buildEvents(ctx, report)
+	if err != nil {
+		return report, err
+	}
+	if scope.DryRun {
+		return report, nil
+	}
+	save, processErr := scope.handleEvents(ctx, report.Events)
+	if !save {
+		return report, processErr
+	}
 
-	err = scope.RatingSaver(filteredRating)
+	err = scope.saveRating(ctx, report.FilteredRating)
 	if err != nil {
-		return errors.WithMessage(err, "cannot save rating")
+		return report, stderrors.Join(processErr, errors.WithMessage(err, "cannot save rating"))
 	}
 
-	return nil
+	err = scope.savePending(ctx, report.Pending)
+	if err != nil {
+		return report, stderrors.Join(processErr, err)
+	}
+
+	return report, processErr
 }
 
-func GetRewardUsers(currentRating []*approto.RatingItem, scope ScopeDislikeReward) error {
-	filteredRating := filterRating(currentRating, scope.RatingFilter)
+func GetRewardUsers(ctx context.Context, currentRating []*approto.RatingItem, scope ScopeDislikeReward) (*RewardReport, error) {
+	started := time.Now()
+	ctx, runID := ensureRunID(ctx)
+	scope.Logger = runLogger(scope.Logger, runID, scope.Name)
+	ctx, span := tracer.Start(ctx, "GetRewardUsers")
+
+	report, err := getRewardUsers(ctx, currentRating, scope)
+	if !scope.DryRun {
+		observeRewardRun(scope.Name, started, currentRating, report, err)
+	}
+
+	attrs := []any{"dry_run", scope.DryRun, "size", len(currentRating), "duration", time.Since(started)}
+	if report != nil {
+		attrs = append(attrs, "filtered", len(currentRating)-len(report.FilteredRating), "rewards", len(report.Rewards))
+	}
+	if err != nil {
+		scope.Logger.ErrorContext(ctx, "rewards run failed", append(attrs, "error", err)...)
+	} else {
+		scope.Logger.InfoContext(ctx, "rewards run finished", attrs...)
+	}
+	endSpan(span, err, append(attrs, "name", scope.Name, "run_id", runID)...)
+	return report, err
+}
+
+func getRewardUsers(ctx context.Context, currentRating []*approto.RatingItem, scope ScopeDislikeReward) (*RewardReport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	report := &RewardReport{
+		DryRun:         scope.DryRun,
+		FilteredRating: filterStage(ctx, scope.Logger, currentRating, scope.RatingFilter),
+	}
 
 	// Получаем награды юзер с их множителями
-	reward := getReward(filteredRating, scope.PayerRatings)
-	for _, rew := range reward {
-		fmt.Printf("reward userID:%v, FactorRuby:%v, FactorVIP:%v", rew.UserID, rew.FactorRuby, rew.FactorVIP)
-		fmt.Println()
+	rewardsCtx, st := startStage(ctx, scope.Logger, "rewards")
+	report.Rewards = getReward(report.FilteredRating, scope.PayerRatings)
+	for _, rew := range report.Rewards {
+		scope.Logger.DebugContext(rewardsCtx, "reward", "user_id", rew.UserID, "factor_ruby", rew.FactorRuby, "factor_vip", rew.FactorVIP)
 	}
+	st.end(rewardsCtx, nil, "rewards", len(report.Rewards))
 
-	return nil
+	if scope.DryRun || scope.RewardsProcessor == nil {
+		return report, nil
+	}
+	payoutCtx, st := startStage(ctx, scope.Logger, "payout")
+	err := scope.RewardsProcessor(payoutCtx, report.Rewards)
+	st.end(payoutCtx, err, "rewards", len(report.Rewards))
+	if err != nil {
+		return report, errors.WithMessage(err, "cannot pay rewards")
+	}
+	return report, nil
+}
+
+// Rewards награды пользователей отфильтрованного рейтинга без выплаты
+func Rewards(currentRating []*approto.RatingItem, scope ScopeDislikeReward) []*RewardUser {
+	return getReward(filterRating(currentRating, scope.RatingFilter), scope.PayerRatings)
+}
+
+// GetEventFromSource берём текущий рейтинг из источника и считаем по нему события
+func GetEventFromSource(ctx context.Context, source interfaces.RatingSource, scope ScopeEvent) (*EventReport, error) {
+	sourceCtx, span := tracer.Start(ctx, "source")
+	currentRating, err := source.GetRating(sourceCtx)
+	endSpan(span, err, "size", len(currentRating))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot get current rating")
+	}
+	return GetEvent(ctx, currentRating, scope)
+}
+
+// GetRewardUsersFromSource берём текущий рейтинг из источника и считаем по нему награды
+func GetRewardUsersFromSource(ctx context.Context, source interfaces.RatingSource, scope ScopeDislikeReward) (*RewardReport, error) {
+	sourceCtx, span := tracer.Start(ctx, "source")
+	currentRating, err := source.GetRating(sourceCtx)
+	endSpan(span, err, "size", len(currentRating))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot get current rating")
+	}
+	return GetRewardUsers(ctx, currentRating, scope)
 }
 
 // filterRating фильтруем пользователей по каким то параметрам
@@ -83,37 +280,75 @@ const (
 type Event struct {
 	UserID uint32
 	Event  int
+	// PreviousChunk и CurrentChunk переход пользователя, 0 - не было в рейтинге
+	PreviousChunk int
+	CurrentChunk  int
+}
+
+// EventName имя события для внешних потребителей
+func EventName(event int) string {
+	switch event {
+	case Out:
+		return "out"
+	case MoveDown:
+		return "move_down"
+	case MoveUp:
+		return "move_up"
+	case Entered:
+		return "entered"
+	}
+	return "unknown"
 }
 
+// convertRatingToChucks пользователи за пределами всех чанков в карту не попадают,
+// выход из последнего чанка - событие Out, а не переход в чанк -1
 func convertRatingToChucks(rating []*approto.RatingItem, chunks [][2]int) map[uint32]int {
 	c := make(map[uint32]int)
 	for idx, j := range rating {
-		c[j.GetUserID()] = getChunks(idx+1, chunks)
+		chunk := getChunks(idx+1, chunks)
+		if chunk < 1 {
+			continue
+		}
+		c[j.GetUserID()] = chunk
 	}
 	return c
 }
 
+// RatingChunks карта userID -> чанк для уже отфильтрованного рейтинга
+func RatingChunks(rating []*approto.RatingItem, chunks [][2]int) map[uint32]int {
+	return convertRatingToChucks(rating, chunks)
+}
+
+// CompareChunks события перехода между двумя картами чанков, например двумя снапшотами
+func CompareChunks(current, previous map[uint32]int) []Event {
+	return createEvents(current, previous)
+}
+
 // сравниваем со старым
 func createEvents(current, previous map[uint32]int) []Event {
 	var events []Event
 	// проверяем на юзеров оставшихся в рейтинге и новых
 	for userID, currentChunk := range current {
 		previousChunk, ok := previous[userID]
-		if !ok {
-			events = append(events, Event{UserID: userID, Event: Entered})
+		if !ok || previousChunk < 1 {
+			events = append(events, Event{UserID: userID, Event: Entered, CurrentChunk: currentChunk})
 		} else if currentChunk == previousChunk {
 			// pass
 		} else if currentChunk > previousChunk { // рейтинг пользователя снизился
-			events = append(events, Event{UserID: userID, Event: MoveDown})
+			events = append(events, Event{UserID: userID, Event: MoveDown, PreviousChunk: previousChunk, CurrentChunk: currentChunk})
 		} else if previousChunk > currentChunk { // рейтинг пользователя вырос
-			events = append(events, Event{UserID: userID, Event: MoveUp})
+			events = append(events, Event{UserID: userID, Event: MoveUp, PreviousChunk: previousChunk, CurrentChunk: currentChunk})
 		} else {
 			panic("undefined contition")
 		}
 	}
-	for userID := range previous {
+	for userID, previousChunk := range previous {
+		if previousChunk < 1 {
+			// старые карты чанков хранили -1 для мест вне чанков
+			continue
+		}
 		if _, ok := current[userID]; !ok {
-			events = append(events, Event{UserID: userID, Event: Out})
+			events = append(events, Event{UserID: userID, Event: Out, PreviousChunk: previousChunk})
 		}
 	}
 	return events
@@ -140,8 +375,9 @@ type RewardUser struct {
 
 func getReward(rating []*approto.RatingItem, placeReward interfaces.PayerRatingsDict) []*RewardUser {
 	var userReward []*RewardUser
+	ratingSize := len(rating)
 	for _, rating := range rating {
-		r := placeReward.GetReward(int(rating.GetRank()))
+		r := placeReward.GetReward(int(rating.GetRank()), ratingSize, rating.GetValue())
 		reward := &RewardUser{
 			UserID:     rating.GetUserID(),
 			FactorRuby: r.GetFactorRuby(),
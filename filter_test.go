@@ -1,14 +1,28 @@
 package ratiing_filter
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
 	approto "proto"
 	"redis"
 	"ratings_filters/interfaces"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -20,7 +34,7 @@ const (
 type TestdictPayerRatings struct {
 }
 
-func (d *TestdictPayerRatings) GetReward(place int) interfaces.Reward {
+func (d *TestdictPayerRatings) GetReward(place, _ int, _ int64) interfaces.Reward {
 	if place == 1 {
 		return interfaces.Reward{
 			FactorRuby: 10,
@@ -108,21 +122,21 @@ func TestRun(t *testing.T) {
 	}
 
 	expectedEvents := []Event{
-		{UserID: 10, Event: Out},
-		{UserID: 25, Event: MoveUp},
+		{UserID: 10, Event: Out, PreviousChunk: 1},
+		{UserID: 25, Event: MoveUp, PreviousChunk: 2, CurrentChunk: 1},
 	}
 
-	err := GetEvent(currentRating, ScopeEvent{
-		EventsProcessor: func(events []Event) error {
+	_, err := GetEvent(context.TODO(), currentRating, ScopeEvent{
+		EventsProcessor: func(_ context.Context, events []Event) error {
 			for _, e := range events {
 				require.Contains(t, expectedEvents, e)
 			}
 			return nil
 		},
-		RatingFetcher: func() ([]*approto.RatingItem, error) {
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
 			return currentRating, nil
 		},
-		RatingSaver: func(r []*approto.RatingItem) error {
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
 			require.True(t, reflect.DeepEqual(expectedFilteredRating, r))
 			return nil
 		},
@@ -134,15 +148,15 @@ func TestRun(t *testing.T) {
 
 	require.NoError(t, err)
 
-	err = GetEvent(currentRating, ScopeEvent{
-		EventsProcessor: func(events []Event) error {
+	_, err = GetEvent(context.TODO(), currentRating, ScopeEvent{
+		EventsProcessor: func(_ context.Context, events []Event) error {
 			require.Len(t, events, 0)
 			return nil
 		},
-		RatingFetcher: func() ([]*approto.RatingItem, error) {
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
 			return currentRating, nil
 		},
-		RatingSaver: func(r []*approto.RatingItem) error {
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
 			require.True(t, reflect.DeepEqual(currentRating, r))
 			return nil
 		},
@@ -154,15 +168,15 @@ func TestRun(t *testing.T) {
 
 	require.NoError(t, err)
 
-	err = GetEvent(nil, ScopeEvent{
-		EventsProcessor: func(e []Event) error {
+	_, err = GetEvent(context.TODO(), nil, ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
 			fmt.Printf("process event: %+v\n", e)
 			return nil
 		},
-		RatingFetcher: func() ([]*approto.RatingItem, error) {
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
 			return getPreviousRating(nil, notFound)
 		},
-		RatingSaver: func(r []*approto.RatingItem) error {
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
 			return saveRating(nil, notFound, r)
 		},
 		RatingFilter: func(item *approto.RatingItem) bool {
@@ -172,15 +186,15 @@ func TestRun(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	err = GetEvent(nil, ScopeEvent{
-		EventsProcessor: func(e []Event) error {
+	_, err = GetEvent(context.TODO(), nil, ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
 			fmt.Printf("process event: %+v\n", e)
 			return nil
 		},
-		RatingFetcher: func() ([]*approto.RatingItem, error) {
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
 			return getPreviousRating(nil, errKey)
 		},
-		RatingSaver: func(r []*approto.RatingItem) error {
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
 			return saveRating(nil, errKey, r)
 		},
 		RatingFilter: func(item *approto.RatingItem) bool {
@@ -190,15 +204,15 @@ func TestRun(t *testing.T) {
 	})
 	require.Error(t, err)
 
-	err = GetEvent(nil, ScopeEvent{
-		EventsProcessor: func(e []Event) error {
+	_, err = GetEvent(context.TODO(), nil, ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
 			fmt.Printf("process event: %+v\n", e)
 			return nil
 		},
-		RatingFetcher: func() ([]*approto.RatingItem, error) {
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
 			return getPreviousRating(nil, notFound)
 		},
-		RatingSaver: func(r []*approto.RatingItem) error {
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
 			return saveRating(nil, errKey, r)
 		},
 		RatingFilter: func(item *approto.RatingItem) bool {
@@ -208,15 +222,15 @@ func TestRun(t *testing.T) {
 	})
 	require.Error(t, err)
 
-	err = GetEvent(nil, ScopeEvent{
-		EventsProcessor: func(e []Event) error {
+	_, err = GetEvent(context.TODO(), nil, ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
 			fmt.Printf("process event: %+v\n", e)
 			return nil
 		},
-		RatingFetcher: func() ([]*approto.RatingItem, error) {
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
 			return getPreviousRating(nil, normal)
 		},
-		RatingSaver: func(r []*approto.RatingItem) error {
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
 			return saveRating(nil, errKey, r)
 		},
 		RatingFilter: func(item *approto.RatingItem) bool {
@@ -228,7 +242,7 @@ func TestRun(t *testing.T) {
 	require.Error(t, err)
 
 	f := TestdictPayerRatings{}
-	err = GetRewardUsers(currentRating, ScopeDislikeReward{
+	_, err = GetRewardUsers(context.TODO(), currentRating, ScopeDislikeReward{
 		RatingFilter: func(item *approto.RatingItem) bool {
 			return false
 		},
@@ -319,6 +333,11 @@ func TestConvertToChunks(t *testing.T) {
 	expectedChunks := map[uint32]int{1: 1, 25: 1, 50: 2}
 	chunks := convertRatingToChucks(rating, definedChunks)
 	require.True(t, reflect.DeepEqual(expectedChunks, chunks))
+
+	// места за пределами чанков в карту не попадают, выход из чанка - Out
+	chunks = convertRatingToChucks(rating, [][2]int{{1, 2}})
+	require.Equal(t, map[uint32]int{1: 1, 25: 1}, chunks)
+	require.Equal(t, []Event{{UserID: 50, Event: Out, PreviousChunk: 1}}, createEvents(chunks, map[uint32]int{1: 1, 25: 1, 50: 1}))
 }
 
 func TestCreateEvents(t *testing.T) {
@@ -326,14 +345,797 @@ func TestCreateEvents(t *testing.T) {
 	currentChunks := map[uint32]int{10: 1, 20: 2, 30: 3, 40: 5, 50: 6}
 	previousChunks := map[uint32]int{20: 1, 30: 4, 40: 5, 50: 6, 60: 7}
 	expectedEvents := []Event{
-		{UserID: 10, Event: Entered},
-		{UserID: 20, Event: MoveDown},
-		{UserID: 30, Event: MoveUp},
-		{UserID: 60, Event: Out},
+		{UserID: 10, Event: Entered, CurrentChunk: 1},
+		{UserID: 20, Event: MoveDown, PreviousChunk: 1, CurrentChunk: 2},
+		{UserID: 30, Event: MoveUp, PreviousChunk: 4, CurrentChunk: 3},
+		{UserID: 60, Event: Out, PreviousChunk: 7},
 	}
 
 	events := createEvents(currentChunks, previousChunks)
 	for _, e := range events {
 		require.Contains(t, expectedEvents, e)
 	}
+
+	// -1 в старых картах чанков - не чанк
+	events = createEvents(map[uint32]int{10: 1}, map[uint32]int{10: -1, 20: -1})
+	require.Equal(t, []Event{{UserID: 10, Event: Entered, CurrentChunk: 1}}, events)
+}
+
+func TestEventsOutsideChunks(t *testing.T) {
+	rating := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+		{UserID: proto.Uint32(2), Rank: proto.Uint32(2), Value: proto.Int64(50)},
+		{UserID: proto.Uint32(3), Rank: proto.Uint32(3), Value: proto.Int64(10)},
+	}
+	chunks := [][2]int{{1, 1}, {2, 2}}
+
+	// раньше 3 получал чанк -1, и выпадение из последнего чанка было MoveUp из 2 в -1
+	events := createEvents(convertRatingToChucks(rating, chunks), map[uint32]int{1: 1, 2: 2, 3: 2})
+	require.Equal(t, []Event{{UserID: 3, Event: Out, PreviousChunk: 2}}, events)
+
+	// а вход из-за пределов чанков по старой карте с -1 был MoveDown из -1 в 2
+	events = createEvents(convertRatingToChucks(rating, chunks), map[uint32]int{1: 1, 2: -1, 3: -1})
+	require.Equal(t, []Event{{UserID: 2, Event: Entered, CurrentChunk: 2}}, events)
+}
+
+func TestGetEventChunkMode(t *testing.T) {
+	chunks := [][2]int{
+		{1, 1},
+		{2, 10},
+	}
+	currentRating := []*approto.RatingItem{
+		{
+			UserID: proto.Uint32(1),
+			Rank:   proto.Uint32(1),
+			Value:  proto.Int64(100),
+		}, {
+			UserID: proto.Uint32(10),
+			Rank:   proto.Uint32(2),
+			Value:  proto.Int64(50),
+		}, {
+			UserID: proto.Uint32(25),
+			Rank:   proto.Uint32(3),
+			Value:  proto.Int64(10),
+		},
+	}
+	stored := map[uint32]int{1: 2, 10: 2, 25: 2, 30: 1}
+
+	var events []Event
+	_, err := GetEvent(context.TODO(), currentRating, ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			events = e
+			return nil
+		},
+		ChunkFetcher: func(context.Context, map[uint32]int) (map[uint32]int, error) {
+			return stored, nil
+		},
+		ChunkSaver: func(_ context.Context, changed map[uint32]int, removed []uint32) error {
+			require.Equal(t, map[uint32]int{1: 1}, changed)
+			require.Equal(t, []uint32{30}, removed)
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Chunks: chunks,
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Event{
+		{UserID: 1, Event: MoveUp, PreviousChunk: 2, CurrentChunk: 1},
+		{UserID: 30, Event: Out, PreviousChunk: 1},
+	}, events)
+
+	// первый запуск сохраняет всю карту без событий
+	_, err = GetEvent(context.TODO(), currentRating, ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			t.Fatalf("unexpected events: %+v", e)
+			return nil
+		},
+		ChunkFetcher: func(context.Context, map[uint32]int) (map[uint32]int, error) {
+			return nil, ErrNotFound
+		},
+		ChunkSaver: func(_ context.Context, changed map[uint32]int, removed []uint32) error {
+			require.Equal(t, map[uint32]int{1: 1, 10: 2, 25: 2}, changed)
+			require.Empty(t, removed)
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Chunks: chunks,
+	})
+	require.NoError(t, err)
+}
+
+func TestGetEventTimeouts(t *testing.T) {
+	scope := ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			return nil
+		},
+		// медленное хранилище, стадия прерывается по таймауту
+		RatingFetcher: func(ctx context.Context) ([]*approto.RatingItem, error) {
+			select {
+			case <-time.After(time.Second):
+				return nil, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
+			t.Fatalf("save after failed fetch")
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Timeouts: StageTimeouts{Fetch: 10 * time.Millisecond},
+	}
+	started := time.Now()
+	_, err := GetEvent(context.TODO(), nil, scope)
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	require.True(t, time.Since(started) < time.Second)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	scope.RatingFetcher = func(context.Context) ([]*approto.RatingItem, error) {
+		t.Fatalf("fetch with canceled context")
+		return nil, nil
+	}
+	_, err = GetEvent(ctx, nil, scope)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+}
+
+func TestGetEventRetry(t *testing.T) {
+	var fetches, saves int
+	scope := ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			fetches++
+			if fetches < 3 {
+				return nil, fmt.Errorf("connection reset")
+			}
+			return nil, ErrNotFound
+		},
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
+			saves++
+			return fmt.Errorf("read only replica")
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Policies: StagePolicies{
+			Fetch: StagePolicy{Retry: &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, Jitter: 0.5}},
+			Save:  StagePolicy{Retry: &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}},
+		},
+	}
+
+	_, err := GetEvent(context.TODO(), nil, scope)
+	require.Error(t, err)
+	require.Equal(t, 3, fetches)
+	require.Equal(t, 2, saves)
+	var retryErr *RetryError
+	require.True(t, errors.As(err, &retryErr), err)
+	require.Equal(t, 2, retryErr.Attempts)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := &CircuitBreaker{Threshold: 2, Cooldown: 50 * time.Millisecond}
+	var calls int
+	fetch := func(context.Context) ([]*approto.RatingItem, error) {
+		calls++
+		return nil, fmt.Errorf("redis is down")
+	}
+	policy := StagePolicy{Breaker: breaker}
+
+	for i := 0; i < 4; i++ {
+		_, err := runPolicy(context.TODO(), 0, policy, fetch)
+		require.Error(t, err)
+	}
+	require.Equal(t, 2, calls)
+	_, err := runPolicy(context.TODO(), 0, policy, fetch)
+	require.Equal(t, ErrCircuitOpen, errors.Cause(err))
+
+	// после паузы пропускаем пробный вызов, успех замыкает предохранитель
+	time.Sleep(60 * time.Millisecond)
+	_, err = runPolicy(context.TODO(), 0, policy, func(context.Context) ([]*approto.RatingItem, error) {
+		calls++
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+	require.True(t, breaker.allow())
+
+	// отмена не считается ни неудачей, ни успехом пробного вызова
+	breaker = &CircuitBreaker{Threshold: 1, Cooldown: 50 * time.Millisecond}
+	breaker.record(fmt.Errorf("redis is down"))
+	require.False(t, breaker.allow())
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, breaker.allow())
+	breaker.record(context.Canceled)
+	require.True(t, breaker.allow())
+	require.False(t, breaker.allow())
+}
+
+func TestProcessRetryOptIn(t *testing.T) {
+	var calls int
+	scope := ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			calls++
+			return fmt.Errorf("sink is down")
+		},
+		Policies: StagePolicies{
+			Process: StagePolicy{Retry: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}},
+		},
+	}
+	// повтор без явного Retryable - ошибка настройки, а не тихий отказ от повторов
+	events := []Event{{UserID: 1, Event: Entered, CurrentChunk: 1}}
+	_, err := GetEvent(context.TODO(), nil, scope)
+	require.Error(t, err)
+	require.Equal(t, 0, calls)
+
+	scope.Policies.Process.Retry.Retryable = IsRetryable
+	require.Error(t, scope.processBatch(context.TODO(), events))
+	require.Equal(t, 3, calls)
+
+	require.False(t, IsRetryable(errors.WithMessage(context.DeadlineExceeded, "cannot save rating")))
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	require.Equal(t, 10*time.Millisecond, p.delay(1))
+	require.Equal(t, 20*time.Millisecond, p.delay(2))
+	require.Equal(t, 40*time.Millisecond, p.delay(3))
+	require.Equal(t, 50*time.Millisecond, p.delay(4))
+	require.Equal(t, 50*time.Millisecond, p.delay(100))
+}
+
+func TestGetEventProcessFailurePolicy(t *testing.T) {
+	currentRating := []*approto.RatingItem{
+		{
+			UserID: proto.Uint32(1),
+			Rank:   proto.Uint32(1),
+			Value:  proto.Int64(100),
+		},
+	}
+	newScope := func(policy ProcessFailurePolicy, saved *bool) ScopeEvent {
+		return ScopeEvent{
+			EventsProcessor: func(_ context.Context, e []Event) error {
+				return fmt.Errorf("push service unavailable")
+			},
+			RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+				return nil, nil
+			},
+			RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
+				*saved = true
+				return nil
+			},
+			RatingFilter: func(item *approto.RatingItem) bool {
+				return false
+			},
+			Chunks:         [][2]int{{1, 10}},
+			OnProcessError: policy,
+		}
+	}
+
+	var saved bool
+	_, err := GetEvent(context.TODO(), currentRating, newScope(AbortOnProcessError, &saved))
+	require.Error(t, err)
+	require.False(t, saved)
+
+	saved = false
+	_, err = GetEvent(context.TODO(), currentRating, newScope(SaveOnProcessError, &saved))
+	require.Error(t, err)
+	require.True(t, saved)
+
+	saved = false
+	var deadLetters []Event
+	scope := newScope(DeadLetterOnProcessError, &saved)
+	scope.DeadLetter = func(_ context.Context, events []Event, cause error) error {
+		require.Error(t, cause)
+		deadLetters = append(deadLetters, events...)
+		return nil
+	}
+	_, err = GetEvent(context.TODO(), currentRating, scope)
+	require.True(t, errors.Is(err, ErrDeadLettered), err)
+	require.True(t, saved)
+	require.Equal(t, []Event{{UserID: 1, Event: Entered, CurrentChunk: 1}}, deadLetters)
+
+	// события не потеряются, если их некуда отложить
+	saved = false
+	scope.DeadLetter = func(_ context.Context, events []Event, cause error) error {
+		return fmt.Errorf("dead letter store unavailable")
+	}
+	_, err = GetEvent(context.TODO(), currentRating, scope)
+	require.Error(t, err)
+	require.False(t, saved)
+}
+
+func TestGetEventBatches(t *testing.T) {
+	var currentRating []*approto.RatingItem
+	for i := 1; i <= 25; i++ {
+		currentRating = append(currentRating, &approto.RatingItem{
+			UserID: proto.Uint32(uint32(i)),
+			Rank:   proto.Uint32(uint32(i)),
+			Value:  proto.Int64(int64(100 - i)),
+		})
+	}
+
+	var (
+		mu        sync.Mutex
+		processed []Event
+		failed    []Event
+		sizes     []int
+	)
+	scope := ScopeEvent{
+		// вызывается из воркеров, поэтому только запоминаем, проверяем после GetEvent
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sizes = append(sizes, len(e))
+			for _, event := range e {
+				if event.UserID == 15 {
+					return fmt.Errorf("cannot push user 15")
+				}
+			}
+			processed = append(processed, e...)
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return nil, nil
+		},
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Chunks:         [][2]int{{1, 100}},
+		OnProcessError: DeadLetterOnProcessError,
+		DeadLetter: func(_ context.Context, events []Event, cause error) error {
+			var batchErr *BatchError
+			require.True(t, errors.As(cause, &batchErr))
+			require.Equal(t, 3, batchErr.Batches)
+			require.Equal(t, 25, batchErr.Total)
+			require.Len(t, batchErr.Failed, 1)
+			require.Equal(t, 25-len(events), batchErr.Processed)
+			failed = events
+			return nil
+		},
+		Batch: BatchOptions{Size: 10, Workers: 3},
+	}
+
+	_, err := GetEvent(context.TODO(), currentRating, scope)
+	require.True(t, errors.Is(err, ErrDeadLettered), err)
+	var batchErr *BatchError
+	require.True(t, errors.As(err, &batchErr))
+	require.ElementsMatch(t, []int{10, 10, 5}, sizes)
+	require.Contains(t, failed, Event{UserID: 15, Event: Entered, CurrentChunk: 1})
+	require.Len(t, append(processed, failed...), 25)
+}
+
+func TestGetEventHysteresis(t *testing.T) {
+	ratingOf := func(userIDs ...uint32) []*approto.RatingItem {
+		var rating []*approto.RatingItem
+		for idx, userID := range userIDs {
+			rating = append(rating, &approto.RatingItem{
+				UserID: proto.Uint32(userID),
+				Rank:   proto.Uint32(uint32(idx + 1)),
+				Value:  proto.Int64(int64(100 - idx)),
+			})
+		}
+		return rating
+	}
+
+	var (
+		snapshot  = ratingOf(1, 2, 3, 4, 5, 6)
+		pending   map[uint32]PendingChange
+		processed []Event
+	)
+	scope := ScopeEvent{
+		EventsProcessor: func(_ context.Context, e []Event) error {
+			processed = e
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return snapshot, nil
+		},
+		RatingSaver: func(_ context.Context, r []*approto.RatingItem) error {
+			snapshot = r
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Chunks:     [][2]int{{1, 2}, {3, 6}},
+		Hysteresis: &Hysteresis{Runs: 2, Places: 2},
+		PendingFetcher: func(context.Context) (map[uint32]PendingChange, error) {
+			if pending == nil {
+				return nil, ErrNotFound
+			}
+			return pending, nil
+		},
+		PendingSaver: func(_ context.Context, p map[uint32]PendingChange) error {
+			pending = p
+			return nil
+		},
+	}
+
+	// 2 и 3 поменялись местами у границы - событий нет, переходы ждут подтверждения
+	_, err := GetEvent(context.TODO(), ratingOf(1, 3, 2, 4, 5, 6), scope)
+	require.NoError(t, err)
+	require.Empty(t, processed)
+	require.Equal(t, map[uint32]PendingChange{
+		2: {Chunk: 1, Candidate: 2, Runs: 1},
+		3: {Chunk: 2, Candidate: 1, Runs: 1},
+	}, pending)
+
+	// вернулись обратно - пользователи ничего не заметили
+	_, err = GetEvent(context.TODO(), ratingOf(1, 2, 3, 4, 5, 6), scope)
+	require.NoError(t, err)
+	require.Empty(t, processed)
+	require.Empty(t, pending)
+
+	// 6 и 2 зашли за границу на 2 места и засчитываются сразу, 3 и 1 - на втором запуске подряд
+	_, err = GetEvent(context.TODO(), ratingOf(6, 3, 1, 2, 4, 5), scope)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Event{
+		{UserID: 6, Event: MoveUp, PreviousChunk: 2, CurrentChunk: 1},
+		{UserID: 2, Event: MoveDown, PreviousChunk: 1, CurrentChunk: 2},
+	}, processed)
+	_, err = GetEvent(context.TODO(), ratingOf(6, 3, 1, 2, 4, 5), scope)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Event{
+		{UserID: 3, Event: MoveUp, PreviousChunk: 2, CurrentChunk: 1},
+		{UserID: 1, Event: MoveDown, PreviousChunk: 1, CurrentChunk: 2},
+	}, processed)
+	require.Empty(t, pending)
+
+	// без PendingSaver гистерезис не запускается
+	scope.PendingSaver = nil
+	_, err = GetEvent(context.TODO(), ratingOf(1, 2, 3, 4, 5, 6), scope)
+	require.Error(t, err)
+}
+
+func TestGetEventDryRun(t *testing.T) {
+	previous := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+		{UserID: proto.Uint32(2), Rank: proto.Uint32(2), Value: proto.Int64(50)},
+	}
+	current := []*approto.RatingItem{
+		{UserID: proto.Uint32(2), Rank: proto.Uint32(1), Value: proto.Int64(120)},
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(2), Value: proto.Int64(100)},
+		{UserID: proto.Uint32(3), Rank: proto.Uint32(3), Value: proto.Int64(10)},
+	}
+	scope := ScopeEvent{
+		EventsProcessor: func(context.Context, []Event) error {
+			t.Fatal("events processed in dry run")
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return previous, nil
+		},
+		RatingSaver: func(context.Context, []*approto.RatingItem) error {
+			t.Fatal("rating saved in dry run")
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return item.GetUserID() == 3
+		},
+		Chunks: [][2]int{{1, 1}, {2, 10}},
+		DryRun: true,
+	}
+
+	report, err := GetEvent(context.TODO(), current, scope)
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, current[:2], report.FilteredRating)
+	require.Equal(t, map[uint32]int{1: 2, 2: 1}, report.CurrentChunks)
+	require.Equal(t, map[uint32]int{1: 1, 2: 2}, report.PreviousChunks)
+	require.ElementsMatch(t, []Event{
+		{UserID: 1, Event: MoveDown, PreviousChunk: 1, CurrentChunk: 2},
+		{UserID: 2, Event: MoveUp, PreviousChunk: 2, CurrentChunk: 1},
+	}, report.Events)
+
+	// в режиме карты чанков первый запуск тоже ничего не пишет
+	scope.ChunkFetcher = func(context.Context, map[uint32]int) (map[uint32]int, error) {
+		return nil, ErrNotFound
+	}
+	scope.ChunkSaver = func(context.Context, map[uint32]int, []uint32) error {
+		t.Fatal("chunks saved in dry run")
+		return nil
+	}
+	report, err = GetEvent(context.TODO(), current, scope)
+	require.NoError(t, err)
+	require.Nil(t, report.PreviousChunks)
+	require.Empty(t, report.Events)
+
+	f := TestdictPayerRatings{}
+	paid := 0
+	rewardScope := ScopeDislikeReward{
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		PayerRatings: &f,
+		RewardsProcessor: func(_ context.Context, rewards []*RewardUser) error {
+			paid += len(rewards)
+			return nil
+		},
+		DryRun: true,
+	}
+	rewards, err := GetRewardUsers(context.TODO(), current, rewardScope)
+	require.NoError(t, err)
+	require.Len(t, rewards.Rewards, 3)
+	require.Zero(t, paid)
+
+	rewardScope.DryRun = false
+	_, err = GetRewardUsers(context.TODO(), current, rewardScope)
+	require.NoError(t, err)
+	require.Equal(t, 3, paid)
+}
+
+func TestGetEventLock(t *testing.T) {
+	rating := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+	}
+	locker := &MemoryLocker{}
+	var tokens []int64
+	scope := ScopeEvent{
+		EventsProcessor: func(context.Context, []Event) error {
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return nil, ErrNotFound
+		},
+		RatingSaver: func(ctx context.Context, _ []*approto.RatingItem) error {
+			token, ok := FencingToken(ctx)
+			require.True(t, ok)
+			tokens = append(tokens, token)
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Chunks:  [][2]int{{1, 10}},
+		Locker:  locker,
+		LockKey: "rating:test:likes:20210310:lock",
+	}
+
+	_, err := GetEvent(context.TODO(), rating, scope)
+	require.NoError(t, err)
+	_, err = GetEvent(context.TODO(), rating, scope)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2}, tokens)
+
+	// пока блокировку держит другой запуск, рейтинг не обрабатываем
+	lock, err := locker.Lock(context.TODO(), scope.LockKey)
+	require.NoError(t, err)
+	_, err = GetEvent(context.TODO(), rating, scope)
+	require.Equal(t, ErrLocked, errors.Cause(err))
+	require.NoError(t, lock.Unlock(context.TODO()))
+
+	// потеря блокировки отменяет стадии
+	scope.RatingSaver = func(ctx context.Context, _ []*approto.RatingItem) error {
+		locker.expire(scope.LockKey)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	_, err = GetEvent(context.TODO(), rating, scope)
+	require.True(t, errors.Is(err, ErrLockLost))
+
+	// после потери ключ снова свободен
+	lock, err = locker.Lock(context.TODO(), scope.LockKey)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), lock.Token())
+}
+
+func TestGetEventMetrics(t *testing.T) {
+	previous := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+	}
+	current := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+		{UserID: proto.Uint32(2), Rank: proto.Uint32(2), Value: proto.Int64(50)},
+		{UserID: proto.Uint32(3), Rank: proto.Uint32(3), Value: proto.Int64(10)},
+	}
+	scope := ScopeEvent{
+		Name: "metrics",
+		EventsProcessor: func(context.Context, []Event) error {
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return previous, nil
+		},
+		RatingSaver: func(context.Context, []*approto.RatingItem) error {
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return item.GetUserID() == 3
+		},
+		Chunks: [][2]int{{1, 1}, {2, 10}, {11, 20}},
+	}
+
+	_, err := GetEvent(context.TODO(), current, scope)
+	require.NoError(t, err)
+	require.Equal(t, float64(3), testutil.ToFloat64(ratingSize.WithLabelValues("metrics")))
+	require.Equal(t, float64(1), testutil.ToFloat64(filteredUsers.WithLabelValues("metrics")))
+	require.Equal(t, float64(1), testutil.ToFloat64(eventsTotal.WithLabelValues("metrics", "entered")))
+	require.Equal(t, float64(1), testutil.ToFloat64(chunkUsers.WithLabelValues("metrics", "2")))
+	require.Equal(t, float64(0), testutil.ToFloat64(chunkUsers.WithLabelValues("metrics", "3")))
+
+	// пробные запуски в метрики не попадают
+	scope.DryRun = true
+	_, err = GetEvent(context.TODO(), current, scope)
+	require.NoError(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(eventsTotal.WithLabelValues("metrics", "entered")))
+}
+
+func TestGetEventLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	rating := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+	}
+	scope := ScopeEvent{
+		Name: "likes",
+		EventsProcessor: func(ctx context.Context, _ []Event) error {
+			require.Equal(t, "run-1", RunID(ctx))
+			return fmt.Errorf("cannot push")
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return nil, nil
+		},
+		RatingSaver: func(context.Context, []*approto.RatingItem) error {
+			return nil
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return false
+		},
+		Chunks: [][2]int{{1, 10}},
+		Logger: logger,
+	}
+
+	_, err := GetEvent(WithRunID(context.TODO(), "run-1"), rating, scope)
+	require.Error(t, err)
+
+	var stages []string
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	for _, line := range lines {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &entry))
+		require.Equal(t, "run-1", entry["run_id"])
+		require.Equal(t, "likes", entry["rating"])
+		if stage, ok := entry["stage"].(string); ok {
+			stages = append(stages, stage)
+		}
+	}
+	require.Equal(t, []string{"filter", "chunks", "fetch", "chunks", "events", "process"}, stages)
+
+	var last map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &last))
+	require.Equal(t, "events run failed", last["msg"])
+	require.Equal(t, float64(1), last["events"])
+}
+
+func TestGetEventSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	rating := []*approto.RatingItem{
+		{UserID: proto.Uint32(1), Rank: proto.Uint32(1), Value: proto.Int64(100)},
+		{UserID: proto.Uint32(2), Rank: proto.Uint32(2), Value: proto.Int64(50)},
+	}
+	scope := ScopeEvent{
+		Name: "likes",
+		EventsProcessor: func(ctx context.Context, _ []Event) error {
+			return nil
+		},
+		RatingFetcher: func(context.Context) ([]*approto.RatingItem, error) {
+			return nil, ErrNotFound
+		},
+		RatingSaver: func(context.Context, []*approto.RatingItem) error {
+			return fmt.Errorf("cannot save")
+		},
+		RatingFilter: func(item *approto.RatingItem) bool {
+			return item.GetUserID() == 2
+		},
+		Chunks: [][2]int{{1, 10}},
+	}
+
+	_, err := GetEvent(context.TODO(), rating, scope)
+	require.Error(t, err)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	var names []string
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		names = append(names, span.Name())
+	}
+	require.Equal(t, []string{"filter", "chunks", "fetch", "save", "GetEvent"}, names)
+
+	root := spans["GetEvent"]
+	for _, name := range []string{"filter", "chunks", "fetch", "save"} {
+		require.Equal(t, root.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+	require.Equal(t, codes.Error, root.Status().Code)
+	require.Equal(t, codes.Error, spans["save"].Status().Code)
+	require.Equal(t, codes.Unset, spans["fetch"].Status().Code)
+	require.Contains(t, spans["fetch"].Attributes(), attribute.Bool("rating.found", false))
+	require.Contains(t, spans["filter"].Attributes(), attribute.Int("rating.filtered", 1))
+	require.Contains(t, root.Attributes(), attribute.Int("rating.size", 2))
+	require.Contains(t, root.Attributes(), attribute.String("rating.name", "likes"))
+}
+
+func TestNotifier(t *testing.T) {
+	notifier, err := NewNotifier([]TransitionTemplate{
+		{
+			Locale:        "en",
+			TransitionKey: TransitionKey{Event: Entered, To: 1},
+			Title:         "You are in the {{.Chunk}}!",
+			Body:          "Rank {{.Rank}}, reward: {{.Reward}}",
+			Channels:      []string{ChannelPush, ChannelInApp},
+		}, {
+			Locale:        "en",
+			TransitionKey: TransitionKey{Event: Out},
+			Title:         "You dropped out of the {{.PreviousChunk}}",
+		}, {
+			Locale:        "ru",
+			TransitionKey: TransitionKey{Event: Out},
+			Title:         "Вы выбыли из {{.PreviousChunk}}",
+		},
+	})
+	require.NoError(t, err)
+	notifier.DefaultLocale = "en"
+	notifier.ChunkNames = map[int]string{1: "top 10"}
+	notifier.UserData = func(_ context.Context, userID uint32) (NotificationData, error) {
+		if userID == 2 {
+			return NotificationData{Locale: "ru"}, nil
+		}
+		return NotificationData{Locale: "de", Rank: 3, Reward: "100 rubies"}, nil
+	}
+	now := time.Now()
+	notifier.Limiter = &MemoryRateLimiter{Limit: 1, Window: time.Hour, clock: func() time.Time { return now }}
+
+	// неудачная отправка не расходует лимит
+	notifier.Send = func(_ context.Context, n []Notification) error {
+		return fmt.Errorf("push service unavailable")
+	}
+	err = notifier.Processor()(context.TODO(), []Event{{UserID: 1, Event: Entered, CurrentChunk: 1}})
+	require.Error(t, err)
+
+	var sent []Notification
+	notifier.Send = func(_ context.Context, n []Notification) error {
+		sent = append(sent, n...)
+		return nil
+	}
+
+	err = notifier.Processor()(context.TODO(), []Event{
+		{UserID: 1, Event: Entered, CurrentChunk: 1},
+		{UserID: 2, Event: Out, PreviousChunk: 1},
+		// нет шаблона
+		{UserID: 3, Event: MoveDown, PreviousChunk: 1, CurrentChunk: 2},
+		// лимит уже исчерпан
+		{UserID: 1, Event: Out, PreviousChunk: 1},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Notification{
+		{UserID: 1, Channel: ChannelPush, Locale: "en", Title: "You are in the top 10!", Body: "Rank 3, reward: 100 rubies"},
+		{UserID: 1, Channel: ChannelInApp, Locale: "en", Title: "You are in the top 10!", Body: "Rank 3, reward: 100 rubies"},
+		{UserID: 2, Channel: ChannelPush, Locale: "ru", Title: "Вы выбыли из top 10"},
+	}, sent)
+
+	// окно прошло
+	now = now.Add(2 * time.Hour)
+	sent = nil
+	err = notifier.Processor()(context.TODO(), []Event{{UserID: 1, Event: Out, PreviousChunk: 2}})
+	require.NoError(t, err)
+	require.Equal(t, []Notification{
+		{UserID: 1, Channel: ChannelPush, Locale: "en", Title: "You dropped out of the 2"},
+	}, sent)
+
+	_, err = NewNotifier([]TransitionTemplate{{Locale: "en", Title: "{{.Rank"}})
+	require.Error(t, err)
 }
@@ -3,40 +3,63 @@ package helpers
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"github.com/garyburd/redigo/redis"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
-	approto "cporot-compile"
-	"go.mongodb.org/mongo-driver/bson"
+	"math"
+	approto "proto-compile"
 	"go.mongodb.org/mongo-driver/mongo"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	r "ratings_filters/rating_filter"
 	"sort"
+	"time"
 )
 
 //GetPreviousRating получаем предыдущий рейт пользователя из редис
-func GetPreviousRating(pool redis.Pool, key string) ([]*approto.RatingItem, error) {
-	var rating []*approto.RatingItem
-	b, err := redis.Bytes(pool.Do(0, "GET", key))
+func GetPreviousRating(ctx context.Context, pool redis.Pool, key RatingKey) ([]*approto.RatingItem, error) {
+	err := key.Validate()
+	if err != nil {
+		return nil, err
+	}
+	b, err := redis.Bytes(doContext(ctx, pool, "GET", key.String()))
 	if err == redis.ErrNil {
 		return nil, r.ErrNotFound
 	} else if err != nil {
 		return nil, errors.WithMessage(err, "cannot fetch rating")
 	}
-	err = json.Unmarshal(b, &rating)
+	rating, err := DecodeSnapshot(b)
 	if err != nil {
 		return nil, errors.WithMessage(err, "cannot unmarshal rating")
 	}
 	return rating, nil
 }
 
-func SaveRating(pool redis.Pool, key string, rating []*approto.RatingItem) error {
-	b, err := json.Marshal(rating)
+// SnapshotOptions параметры сохранения снапшота рейтинга
+type SnapshotOptions struct {
+	// Codec формат снапшота, nil - JSON
+	Codec SnapshotCodec
+	// TTL время жизни снапшота, 0 - бессрочно
+	TTL time.Duration
+}
+
+func SaveRating(ctx context.Context, pool redis.Pool, key RatingKey, rating []*approto.RatingItem, opts SnapshotOptions) error {
+	err := key.Validate()
+	if err != nil {
+		return err
+	}
+	codec := opts.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+	b, err := codec.Encode(rating)
 	if err != nil {
 		return errors.WithMessage(err, "cannot marshal rating")
 	}
-	_, err = pool.Do(0, "SET", key, b)
+	args := redis.Args{}.Add(b)
+	if opts.TTL > 0 {
+		args = args.Add("PX", opts.TTL.Milliseconds())
+	}
+	_, err = doFenced(ctx, pool, key, "SET", key.String(), args...)
 	if err != nil {
 		return errors.WithMessage(err, "cannot save rating")
 	}
@@ -44,12 +67,18 @@ func SaveRating(pool redis.Pool, key string, rating []*approto.RatingItem) error
 }
 
 // GetDislikesByEndOfDate условная и пока теоретическая реализация, получаем слепок
-func GetDislikesByEndOfDate(sqlPool *mysql.ConnectionsPool, date int64) (dislikeUser map[uint32]int64, err error) {
-	err = sqlPool.SelectRow("SELECT user_id, DislikeCount FROM Talk.user_like WHERE date=?",
-		func(row *sql.Row) error {
+func GetDislikesByEndOfDate(ctx context.Context, sqlPool *mysql.ConnectionsPool, date int64) (dislikeUser map[uint32]int64, err error) {
+	// пул mysql контекст не принимает, проверяем хотя бы перед запросом
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer observeStorage(storeMySQL, "select_dislikes", time.Now(), &err)
+	dislikeUser = make(map[uint32]int64)
+	err = sqlPool.Select("SELECT user_id, DislikeCount FROM Talk.user_like WHERE date=?",
+		func(rows *sql.Rows) error {
 			var userID uint32
 			var dislike int64
-			err := row.Scan(&userID, &dislike)
+			err := rows.Scan(&userID, &dislike)
 			if err != nil {
 				return err
 			}
@@ -66,43 +95,67 @@ func GetDislikesByEndOfDate(sqlPool *mysql.ConnectionsPool, date int64) (dislike
 type RatingsUser struct {
 	UserID int64 `bson:"UserID"`
 	Count  int64 `bson:"100"`
+	// TieBreak время достижения очков, заполняется если в схеме задано TieBreakField
+	TieBreak int64 `bson:"-"`
 }
 
-func GetRatings(collection *mongo.Collection) ([]*RankedUser, error) {
+// ReadOptions параметры чтения рейтинга из монги
+type ReadOptions struct {
+	// SkipBadDocuments пропускать документы, которые не разбираются по схеме, вместо ошибки
+	SkipBadDocuments bool
+}
+
+// cursorCloseTimeout курсор закрываем даже если контекст чтения уже отменён
+const cursorCloseTimeout = 5 * time.Second
+
+// GetRatings читает рейтинг из коллекции, поля документов берутся из schema,
+// возвращает также число пропущенных документов при opts.SkipBadDocuments
+func GetRatings(ctx context.Context, collection *mongo.Collection, schema RatingSchema, opts ReadOptions) (rating []*RankedUser, skipped int, err error) {
+	defer observeStorage(storeMongo, "find_ratings", time.Now(), &err)
 	var ratings []*RatingsUser
 
-	cur, err := collection.Find(context.TODO(), bson.D{{}})
+	cur, err := collection.Find(ctx, schema.filter(), options.Find().SetProjection(schema.projection()))
 	if err != nil {
-		return nil, err
+		return nil, 0, errors.WithMessage(err, "cannot find ratings")
 	}
-	defer func(cur *mongo.Cursor, ctx context.Context) {
-		err := cur.Close(ctx)
-		if err != nil {
-
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), cursorCloseTimeout)
+		defer cancel()
+		closeErr := cur.Close(closeCtx)
+		if closeErr != nil && err == nil {
+			rating, err = nil, errors.WithMessage(closeErr, "cannot close ratings cursor")
 		}
-	}(cur, context.TODO())
+	}()
 
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
+		// внутри одной страницы курсор контекст не проверяет
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, skipped, errors.WithMessage(ctxErr, "ratings reading interrupted")
+		}
 
-		var elem RatingsUser
-		err := cur.Decode(&elem)
-		if err != nil {
-			log.Fatal(err)
+		elem, decodeErr := schema.decode(cur.Current)
+		if decodeErr != nil {
+			if opts.SkipBadDocuments {
+				skipped++
+				continue
+			}
+			return nil, skipped, errors.WithMessagef(decodeErr, "cannot decode rating document %s", cur.Current)
 		}
 
-		ratings = append(ratings, &elem)
+		ratings = append(ratings, elem)
 	}
 
-	if err := cur.Err(); err != nil {
-		panic(err)
+	if curErr := cur.Err(); curErr != nil {
+		return nil, skipped, errors.WithMessage(curErr, "cannot iterate ratings")
 	}
 
-	return getRankedUser(ratings), nil
+	return getRankedUser(ratings), skipped, nil
 }
 
 type RankedUser struct {
 	Rank   int64
 	UserID int64
+	Value  int64
 }
 type RankedUsers []*RatingsUser
 
@@ -114,6 +167,9 @@ func (r RankedUsers) Less(i, j int) bool {
 	if r[i].Count != r[j].Count {
 		return r[i].Count > r[j].Count
 	}
+	if r[i].TieBreak != r[j].TieBreak {
+		return r[i].TieBreak < r[j].TieBreak
+	}
 	return r[i].UserID < r[j].UserID
 }
 
@@ -132,6 +188,7 @@ func getRankedUser(rating []*RatingsUser) []*RankedUser {
 		rankedUser := &RankedUser{
 			Rank:   int64(i + 1),
 			UserID: ra.UserID,
+			Value:  ra.Count,
 		}
 		rankUsers = append(rankUsers, rankedUser)
 	}
@@ -139,15 +196,34 @@ func getRankedUser(rating []*RatingsUser) []*RankedUser {
 	return rankUsers
 }
 
+// ErrOverflow место или пользователь не помещаются в uint32 RatingItem
+var ErrOverflow = errors.New("value overflows uint32")
+
 // RatingConverter превращает рейтинги из монги в proto ratingItems(скорее всего  не понадобится) но облегчит обратную совместимость
 // если потом мы захотим брать рейтинги из сервиса
-func RatingConverter(rating []*RankedUser) []*approto.RatingItem {
+func RatingConverter(rating []*RankedUser) ([]*approto.RatingItem, error) {
 	var pRating []*approto.RatingItem
 	for _, item := range rating {
+		rank, err := toUint32(item.Rank)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "rank of user %d", item.UserID)
+		}
+		userID, err := toUint32(item.UserID)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "userID at rank %d", item.Rank)
+		}
 		pRating = append(pRating, &approto.RatingItem{
-			Rank:   proto.Uint32(uint32(item.Rank)),
-			UserID: proto.Uint32(uint32(item.UserID)),
+			Rank:   proto.Uint32(rank),
+			UserID: proto.Uint32(userID),
+			Value:  proto.Int64(item.Value),
 		})
 	}
-	return pRating
+	return pRating, nil
+}
+
+func toUint32(v int64) (uint32, error) {
+	if v < 0 || v > math.MaxUint32 {
+		return 0, errors.WithMessagef(ErrOverflow, "%d", v)
+	}
+	return uint32(v), nil
 }
@@ -2,10 +2,13 @@ package helpers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/ory/dockertest"
 	"github.com/ory/dockertest/docker"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/require"
 	approto "proto-compile"
@@ -13,8 +16,15 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	r "ratings_filters/rating_filter"
 	"testing"
+	"time"
 )
 
 var redisTest redis.Pool
@@ -157,12 +167,101 @@ func TestNewDictPayerRatings(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int64(10), raiting.rewards[0].GetFactorRuby())
 	require.Equal(t, int64(10), raiting.rewards[0].GetFactorVIP())
-	reward := raiting.GetReward(1)
+	reward := raiting.GetReward(1, 1, 0)
 	require.Equal(t, int64(10), reward.GetFactorVIP())
 	require.Equal(t, int64(10), reward.GetFactorRuby())
+
+	bands := raiting.Bands()
+	require.Len(t, bands, len(raiting.rewards))
+	require.Equal(t, bandPlace, bands[0].Band)
+	require.Equal(t, 1, bands[0].From)
+	require.Equal(t, int64(10), bands[0].FactorRuby)
 }
 
-const redisKey = "randomKey"
+// полосы по местам, процентам и порогам очков вперемешку
+func TestDictPayerRatingsBands(t *testing.T) {
+	newReward := func(band string, lBound, uBound int, factor int64) *reward {
+		return &reward{
+			band:   band,
+			lBound: lBound,
+			uBound: uBound,
+			AdmTalkDictPayerRatingData: &approto.AdmTalkDictPayerRatingData{
+				FactorRuby: proto.Int64(factor),
+				FactorVIP:  proto.Int64(factor),
+			},
+		}
+	}
+	dict := &dictPayerRatings{
+		rewards: []*reward{
+			newReward(bandPlace, 1, 3, 10),
+			newReward(bandPercent, 0, 10, 5),
+			newReward(bandPercent, 10, 50, 2),
+			newReward(bandScore, 0, 100, 1),
+			newReward(bandScore, 0, 1000, 3),
+		},
+	}
+
+	cases := []struct {
+		place, size int
+		value       int64
+		expected    int64
+	}{
+		{place: 2, size: 30, value: 0, expected: 10},
+		{place: 3, size: 30000, value: 0, expected: 10},
+		{place: 100, size: 30000, value: 0, expected: 5},
+		{place: 10, size: 30, value: 0, expected: 2},
+		{place: 29, size: 30, value: 150, expected: 1},
+		{place: 29, size: 30, value: 5000, expected: 3},
+		{place: 29, size: 30, value: 10, expected: 0},
+		{place: 29, size: 0, value: 10, expected: 0},
+	}
+	for idx, c := range cases {
+		r := dict.GetReward(c.place, c.size, c.value)
+		require.Equal(t, c.expected, r.GetFactorRuby(), idx)
+		require.Equal(t, c.expected, r.GetFactorVIP(), idx)
+	}
+}
+
+func TestDictPayerRatingsValidate(t *testing.T) {
+	newReward := func(band string, lBound, uBound int, factor int64) *reward {
+		return &reward{
+			band:   band,
+			lBound: lBound,
+			uBound: uBound,
+			AdmTalkDictPayerRatingData: &approto.AdmTalkDictPayerRatingData{
+				FactorRuby: proto.Int64(factor),
+				FactorVIP:  proto.Int64(factor),
+			},
+		}
+	}
+	valid := &dictPayerRatings{
+		rewards: []*reward{
+			newReward(bandPlace, 1, 3, 10),
+			newReward(bandPercent, 0, 10, 5),
+			newReward(bandScore, 1, 100, 1),
+		},
+	}
+	require.NoError(t, valid.Validate())
+	require.Error(t, (&dictPayerRatings{}).Validate())
+
+	invalid := &dictPayerRatings{
+		rewards: []*reward{
+			newReward(bandPlace, 1, 3, 10),
+			newReward(bandPlace, 4, 3, 10),
+			newReward(bandPercent, 0, 120, 5),
+			newReward(bandScore, 1, 100, -1),
+			newReward(bandScore, 100, 100, 1),
+		},
+	}
+	err := invalid.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "place band 4-3")
+	require.Contains(t, err.Error(), "percent band 0-120")
+	require.Contains(t, err.Error(), "negative factor")
+	require.Contains(t, err.Error(), "score threshold 100")
+}
+
+var redisKey = RatingKey{Env: "test", Name: "random", Period: "20210310"}
 
 func TestSaveGetRating(t *testing.T) {
 	rating := []*approto.RatingItem{
@@ -180,12 +279,450 @@ func TestSaveGetRating(t *testing.T) {
 			Value:  proto.Int64(10),
 		},
 	}
-	err := SaveRating(redisTest, redisKey, rating)
+	for _, codec := range []SnapshotCodec{nil, ProtoCodec, ZstdCodec(DeltaCodec)} {
+		err := SaveRating(context.TODO(), redisTest, redisKey, rating, SnapshotOptions{Codec: codec})
+		require.NoError(t, err)
+
+		actualRating, err := GetPreviousRating(context.TODO(), redisTest, redisKey)
+		require.NoError(t, err)
+		require.Equal(t, rating, actualRating)
+	}
+
+	// подчистим редис
+	_, err := redisTest.Do(0, "FLUSHDB")
 	require.NoError(t, err)
+}
 
-	actualRating, err := GetPreviousRating(redisTest, redisKey)
+func TestSnapshotCodecs(t *testing.T) {
+	rating := []*approto.RatingItem{
+		{
+			UserID: proto.Uint32(25),
+			Rank:   proto.Uint32(1),
+			Value:  proto.Int64(100),
+		}, {
+			UserID: proto.Uint32(10),
+			Rank:   proto.Uint32(2),
+			Value:  proto.Int64(-50),
+		}, {
+			UserID: proto.Uint32(math.MaxUint32),
+			Rank:   proto.Uint32(3),
+			Value:  proto.Int64(math.MinInt64),
+		},
+	}
+	codecs := []SnapshotCodec{
+		JSONCodec,
+		ProtoCodec,
+		DeltaCodec,
+		ZstdCodec(ProtoCodec),
+		SnappyCodec(DeltaCodec),
+	}
+	for idx, codec := range codecs {
+		b, err := codec.Encode(rating)
+		require.NoError(t, err, idx)
+		actual, err := DecodeSnapshot(b)
+		require.NoError(t, err, idx)
+		require.Equal(t, rating, actual, idx)
+	}
+
+	// снапшоты, сохранённые до появления кодеков
+	legacy, err := DecodeSnapshot([]byte(`[{"Rank":1,"UserID":25,"Value":100}]`))
+	require.NoError(t, err)
+	require.Equal(t, rating[:1], legacy)
+
+	_, err = DecodeSnapshot([]byte{codecDelta, 200})
+	require.Error(t, err)
+	_, err = DecodeSnapshot(nil)
+	require.Error(t, err)
+}
+
+func TestSaveGetChunkMap(t *testing.T) {
+	key := RatingKey{Env: "test", Name: "chunks", Period: "20210310"}
+	_, err := GetChunkMap(context.TODO(), redisTest, key)
+	require.Equal(t, r.ErrNotFound, err)
+
+	err = SaveChunkMap(context.TODO(), redisTest, key, map[uint32]int{1: 1, 10: 2, 25: 2}, nil, SnapshotOptions{})
+	require.NoError(t, err)
+	err = SaveChunkMap(context.TODO(), redisTest, key, map[uint32]int{10: 1}, []uint32{25}, SnapshotOptions{TTL: time.Minute})
+	require.NoError(t, err)
+
+	chunks, err := GetChunkMap(context.TODO(), redisTest, key)
 	require.NoError(t, err)
-	require.Equal(t, rating, actualRating)
+	require.Equal(t, map[uint32]int{1: 1, 10: 1}, chunks)
+	ttl, err := redis.Int64(redisTest.Do(0, "PTTL", key.ChunksKey()))
+	require.NoError(t, err)
+	require.True(t, ttl > 0 && ttl <= time.Minute.Milliseconds())
+
+	// с редис приходят только отличия от текущих чанков, карта собирается целиком
+	previous, err := GetPreviousChunks(context.TODO(), redisTest, key, map[uint32]int{1: 1, 10: 2, 30: 1})
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]int{1: 1, 10: 1}, previous)
+
+	// опустевшая карта остаётся картой, а не первым запуском
+	err = SaveChunkMap(context.TODO(), redisTest, key, nil, []uint32{1, 10}, SnapshotOptions{})
+	require.NoError(t, err)
+	chunks, err = GetChunkMap(context.TODO(), redisTest, key)
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+	previous, err = GetPreviousChunks(context.TODO(), redisTest, key, map[uint32]int{1: 1})
+	require.NoError(t, err)
+	require.Empty(t, previous)
+	_, err = GetPreviousChunks(context.TODO(), redisTest, RatingKey{Env: "test", Name: "chunks", Period: "20210311"}, nil)
+	require.Equal(t, r.ErrNotFound, err)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+func TestSaveGetPendingChanges(t *testing.T) {
+	key := RatingKey{Env: "test", Name: "pending", Period: "20210310"}
+	_, err := GetPendingChanges(context.TODO(), redisTest, key)
+	require.Equal(t, r.ErrNotFound, err)
+
+	pending := map[uint32]r.PendingChange{7: {Chunk: 1, Candidate: 2, Runs: 1}}
+	err = SavePendingChanges(context.TODO(), redisTest, key, pending, SnapshotOptions{TTL: time.Minute})
+	require.NoError(t, err)
+	saved, err := GetPendingChanges(context.TODO(), redisTest, key)
+	require.NoError(t, err)
+	require.Equal(t, pending, saved)
+
+	// пустое состояние удаляет ключ
+	err = SavePendingChanges(context.TODO(), redisTest, key, nil, SnapshotOptions{})
+	require.NoError(t, err)
+	_, err = GetPendingChanges(context.TODO(), redisTest, key)
+	require.Equal(t, r.ErrNotFound, err)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+func TestRedisLocker(t *testing.T) {
+	key := RatingKey{Env: "test", Name: "lock", Period: "20210310"}.LockKey()
+	locker := &RedisLocker{Pool: redisTest, TTL: 300 * time.Millisecond}
+
+	lock, err := locker.Lock(context.TODO(), key)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), lock.Token())
+	_, err = locker.Lock(context.TODO(), key)
+	require.Equal(t, r.ErrLocked, err)
+
+	// продление держит блокировку дольше TTL
+	time.Sleep(time.Second)
+	_, err = locker.Lock(context.TODO(), key)
+	require.Equal(t, r.ErrLocked, err)
+
+	require.NoError(t, lock.Unlock(context.TODO()))
+	lock, err = locker.Lock(context.TODO(), key)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), lock.Token())
+
+	// перехваченную блокировку продлить не удаётся
+	_, err = redisTest.Do(0, "SET", key, "other")
+	require.NoError(t, err)
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock is not lost")
+	}
+	require.NoError(t, lock.Unlock(context.TODO()))
+	owner, err := redis.String(redisTest.Do(0, "GET", key))
+	require.NoError(t, err)
+	require.Equal(t, "other", owner)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+func TestSaveRatingFenced(t *testing.T) {
+	key := RatingKey{Env: "test", Name: "fenced", Period: "20210310"}
+	locker := &RedisLocker{Pool: redisTest, TTL: time.Minute}
+	stale, err := locker.Lock(context.TODO(), key.LockKey())
+	require.NoError(t, err)
+	require.NoError(t, stale.Unlock(context.TODO()))
+	lock, err := locker.Lock(context.TODO(), key.LockKey())
+	require.NoError(t, err)
+	defer lock.Unlock(context.TODO())
+
+	// запуск с актуальным токеном пишет, со старым - отвергается
+	ctx := r.WithFencingToken(context.TODO(), lock.Token())
+	require.NoError(t, SaveRating(ctx, redisTest, key, nil, SnapshotOptions{}))
+	require.NoError(t, SaveChunkMap(ctx, redisTest, key, map[uint32]int{1: 1}, nil, SnapshotOptions{TTL: time.Hour}))
+
+	ctx = r.WithFencingToken(context.TODO(), stale.Token())
+	require.Equal(t, ErrStaleToken, errors.Cause(SaveRating(ctx, redisTest, key, nil, SnapshotOptions{})))
+	require.Equal(t, ErrStaleToken, errors.Cause(SaveChunkMap(ctx, redisTest, key, nil, []uint32{1}, SnapshotOptions{})))
+	require.Equal(t, ErrStaleToken, errors.Cause(SavePendingChanges(ctx, redisTest, key, nil, SnapshotOptions{})))
+	chunks, err := GetChunkMap(context.TODO(), redisTest, key)
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]int{1: 1}, chunks)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+func TestMarkTick(t *testing.T) {
+	tick := time.Date(2021, 3, 10, 0, 10, 0, 0, time.UTC)
+	key := TickKey("test", "dislikes", tick)
+	require.Equal(t, "ratingtick:test:dislikes:202103100010", key)
+
+	marked, err := MarkTick(context.TODO(), redisTest, key, time.Minute)
+	require.NoError(t, err)
+	require.True(t, marked)
+	marked, err = MarkTick(context.TODO(), redisTest, key, time.Minute)
+	require.NoError(t, err)
+	require.False(t, marked)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+// на зависшем редис блокировка теряется по сроку, а снятие не ждёт дольше своего ctx
+func TestRedisLockBlackholed(t *testing.T) {
+	lock := &redisLock{
+		locker:  &RedisLocker{Pool: blackholeRedis(t), TTL: 200 * time.Millisecond},
+		key:     RatingKey{Env: "test", Name: "lock", Period: "20210310"}.LockKey(),
+		token:   1,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go lock.renew(50*time.Millisecond, time.Now().Add(lock.locker.TTL))
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock is not lost")
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	require.Error(t, lock.Unlock(ctx))
+	require.Less(t, time.Since(started), time.Second)
+}
+
+func TestRatingKey(t *testing.T) {
+	key := RatingKey{Env: "prod", Name: "likes", Period: DailyPeriod(time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC))}
+	require.Equal(t, "rating:prod:likes:20210310", key.String())
+	require.Equal(t, "rating:prod:likes:20210310:chunks", key.ChunksKey())
+	require.Equal(t, "ratingdeadletter:prod:likes:20210310", key.DeadLetterKey())
+
+	parsed, err := ParseRatingKey(key.ChunksKey())
+	require.NoError(t, err)
+	require.Equal(t, key, parsed)
+
+	require.Equal(t, "2021W10", WeeklyPeriod(time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)))
+	require.Error(t, RatingKey{Env: "prod", Name: "a:b", Period: "1"}.Validate())
+	require.Error(t, RatingKey{Env: "prod", Name: "likes"}.Validate())
+	_, err = ParseRatingKey("randomKey")
+	require.Error(t, err)
+}
+
+func TestCleanupRatingKeys(t *testing.T) {
+	for _, period := range []string{"20210301", "20210308", "20210310"} {
+		key := RatingKey{Env: "develop", Name: "likes", Period: period}
+		err := SaveRating(context.TODO(), redisTest, key, nil, SnapshotOptions{TTL: time.Hour})
+		require.NoError(t, err)
+	}
+	err := SaveRating(context.TODO(), redisTest, RatingKey{Env: "prod", Name: "likes", Period: "20210301"}, nil, SnapshotOptions{})
+	require.NoError(t, err)
+	// необработанные события старого периода переживают очистку снапшотов
+	staleKey := RatingKey{Env: "develop", Name: "likes", Period: "20210301"}
+	err = SaveDeadLetters(context.TODO(), redisTest, staleKey, []r.Event{{UserID: 1, Event: r.Out}}, nil)
+	require.NoError(t, err)
+
+	keys, err := ListRatingKeys(context.TODO(), redisTest, RatingKeyPattern("develop", ""))
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+
+	stale, err := CleanupRatingKeys(context.TODO(), redisTest, RatingKeyPattern("develop", "likes"), "20210309", true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"rating:develop:likes:20210301", "rating:develop:likes:20210308"}, stale)
+	keys, err = ListRatingKeys(context.TODO(), redisTest, RatingKeyPattern("", ""))
+	require.NoError(t, err)
+	require.Len(t, keys, 4)
+
+	_, err = CleanupRatingKeys(context.TODO(), redisTest, RatingKeyPattern("develop", "likes"), "20210309", false)
+	require.NoError(t, err)
+	keys, err = ListRatingKeys(context.TODO(), redisTest, RatingKeyPattern("", ""))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"rating:develop:likes:20210310", "rating:prod:likes:20210301"}, keys)
+	exists, err := redis.Bool(redisTest.Do(0, "EXISTS", staleKey.DeadLetterKey()))
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// периоды сравниваются как даты и только в своём формате
+	for _, period := range []string{"2021W09", "2021W10"} {
+		err = SaveRating(context.TODO(), redisTest, RatingKey{Env: "develop", Name: "likes", Period: period}, nil, SnapshotOptions{})
+		require.NoError(t, err)
+	}
+	stale, err = CleanupRatingKeys(context.TODO(), redisTest, RatingKeyPattern("develop", "likes"), "2021W10", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"rating:develop:likes:2021W09"}, stale)
+	stale, err = CleanupRatingKeys(context.TODO(), redisTest, RatingKeyPattern("develop", "likes"), "20210311", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"rating:develop:likes:20210310"}, stale)
+	_, err = CleanupRatingKeys(context.TODO(), redisTest, RatingKeyPattern("develop", "likes"), "2021-03-10", true)
+	require.Error(t, err)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+// отменённый контекст не доходит до редиса
+// blackholeRedis редис, который принимает соединения и ничего не отвечает
+func blackholeRedis(t *testing.T) redis.Pool {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				conn.Close()
+			})
+		}
+	}()
+	return redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", listener.Addr().String())
+		},
+	}
+}
+
+// редис принимает соединение и молчит, стадию всё равно прерывает её таймаут
+func TestGetEventBlackholedRedis(t *testing.T) {
+	pool := blackholeRedis(t)
+
+	key := RatingKey{Env: "test", Name: "blackhole", Period: "20210310"}
+	scope := r.ScopeEvent{
+		EventsProcessor: func(context.Context, []r.Event) error {
+			return nil
+		},
+		RatingFetcher: func(ctx context.Context) ([]*approto.RatingItem, error) {
+			return GetPreviousRating(ctx, pool, key)
+		},
+		RatingSaver: func(ctx context.Context, rating []*approto.RatingItem) error {
+			return SaveRating(ctx, pool, key, rating, SnapshotOptions{})
+		},
+		Chunks:   [][2]int{{1, 10}},
+		Timeouts: r.StageTimeouts{Fetch: 100 * time.Millisecond},
+	}
+	started := time.Now()
+	_, err := r.GetEvent(context.TODO(), nil, scope)
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	require.Less(t, time.Since(started), time.Second)
+}
+
+func TestGetRatingCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, err := GetPreviousRating(ctx, redisTest, redisKey)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	err = SaveRating(ctx, redisTest, redisKey, nil, SnapshotOptions{})
+	require.Equal(t, context.Canceled, errors.Cause(err))
+}
+
+func TestObserveStorage(t *testing.T) {
+	for _, err := range []error{nil, redis.ErrNil, context.Canceled, errors.WithMessage(context.DeadlineExceeded, "cannot fetch")} {
+		observeStorage(storeRedis, "observe_test", time.Now(), &err)
+	}
+	require.Equal(t, float64(0), testutil.ToFloat64(storageErrors.WithLabelValues(storeRedis, "observe_test")))
+
+	err := errors.New("connection refused")
+	observeStorage(storeRedis, "observe_test", time.Now(), &err)
+	require.Equal(t, float64(1), testutil.ToFloat64(storageErrors.WithLabelValues(storeRedis, "observe_test")))
+}
+
+func TestDeadLetters(t *testing.T) {
+	events := []r.Event{{UserID: 1, Event: r.Entered}, {UserID: 2, Event: r.Out}}
+	err := SaveDeadLetters(context.TODO(), redisTest, redisKey, events[:1], fmt.Errorf("push failed"))
+	require.NoError(t, err)
+	err = SaveDeadLetters(context.TODO(), redisTest, redisKey, events[1:], fmt.Errorf("push failed"))
+	require.NoError(t, err)
+
+	var replayedEvents []r.Event
+	failing := func(_ context.Context, e []r.Event) error {
+		return fmt.Errorf("still failing")
+	}
+	replayed, err := ReplayDeadLetters(context.TODO(), redisTest, redisKey, failing)
+	require.Error(t, err)
+	require.Zero(t, replayed)
+
+	replayed, err = ReplayDeadLetters(context.TODO(), redisTest, redisKey, func(_ context.Context, e []r.Event) error {
+		replayedEvents = append(replayedEvents, e...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, replayed)
+	require.Equal(t, events, replayedEvents)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+func TestUserEvents(t *testing.T) {
+	sink := UserEventsSink(redisTest, "test", "likes", 2, time.Hour)
+	require.NoError(t, sink(context.TODO(), []r.Event{{UserID: 1, Event: r.Entered, CurrentChunk: 2}}))
+	require.NoError(t, sink(context.TODO(), []r.Event{{UserID: 1, Event: r.MoveUp, PreviousChunk: 2, CurrentChunk: 1}, {UserID: 2, Event: r.Entered, CurrentChunk: 1}}))
+	require.NoError(t, sink(context.TODO(), []r.Event{{UserID: 1, Event: r.Out, PreviousChunk: 1}}))
+
+	events, err := GetUserEvents(context.TODO(), redisTest, "test", 1, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "out", events[0].Event)
+	require.Equal(t, 1, events[0].PreviousChunk)
+	require.Equal(t, "move_up", events[1].Event)
+	require.Equal(t, "likes", events[1].Rating)
+
+	events, err = GetUserEvents(context.TODO(), redisTest, "test", 2, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	events, err = GetUserEvents(context.TODO(), redisTest, "test", 3, 10)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// события одного пользователя из одной пачки пишутся вместе, новые первыми
+	require.NoError(t, sink(context.TODO(), []r.Event{{UserID: 3, Event: r.Entered, CurrentChunk: 2}, {UserID: 3, Event: r.MoveUp, PreviousChunk: 2, CurrentChunk: 1}}))
+	events, err = GetUserEvents(context.TODO(), redisTest, "test", 3, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "move_up", events[0].Event)
+	require.Equal(t, "entered", events[1].Event)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	limiter := &RedisRateLimiter{Pool: redisTest, Prefix: "notify:likes", Limit: 2, Window: time.Minute}
+	for i, expected := range []int64{2, 1, 0} {
+		remaining, err := limiter.Remaining(context.TODO(), 1)
+		require.NoError(t, err)
+		require.Equal(t, expected, remaining, i)
+		require.NoError(t, limiter.Record(context.TODO(), 1))
+	}
+	remaining, err := limiter.Remaining(context.TODO(), 1)
+	require.NoError(t, err)
+	require.Zero(t, remaining)
+	remaining, err = limiter.Remaining(context.TODO(), 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), remaining)
+
+	ttl, err := redis.Int64(redisTest.Do(0, "PTTL", "notify:likes:1"))
+	require.NoError(t, err)
+	require.True(t, ttl > 0)
 
 	// подчистим редис
 	_, err = redisTest.Do(0, "FLUSHDB")
@@ -194,9 +731,9 @@ func TestSaveGetRating(t *testing.T) {
 
 // если в ключ записанно что-то не то
 func TestSaveRatingErrSaved(t *testing.T) {
-	_, err := redisTest.Do(0, "SET", redisKey, "random")
+	_, err := redisTest.Do(0, "SET", redisKey.String(), "random")
 	require.NoError(t, err)
-	_, err = GetPreviousRating(redisTest, redisKey)
+	_, err = GetPreviousRating(context.TODO(), redisTest, redisKey)
 	require.Error(t, err)
 
 	// подчистим редис
@@ -206,7 +743,7 @@ func TestSaveRatingErrSaved(t *testing.T) {
 
 // если редис пустой
 func TestGetEmpty(t *testing.T) {
-	_, err := GetPreviousRating(redisTest, redisKey)
+	_, err := GetPreviousRating(context.TODO(), redisTest, redisKey)
 	require.Error(t, err)
 
 	// подчистим редис
@@ -218,14 +755,216 @@ func TestGetEmpty(t *testing.T) {
 func TestGetRatings(t *testing.T) {
 	err := insertTestValue(mongoCollection)
 	require.NoError(t, err)
-	rating, err := GetRatings(mongoCollection)
+	rating, skipped, err := GetRatings(context.TODO(), mongoCollection, DefaultRatingSchema, ReadOptions{})
 	require.NoError(t, err)
+	require.Zero(t, skipped)
 	for i, j := range rating {
 		require.Equal(t, j.Rank, int64(i+1))
 	}
 
 }
 
+// тест потокового чтения рейтинга с сортировкой и лимитом в монге
+func TestStreamRatings(t *testing.T) {
+	collection := mongoCollection.Database().Collection("rating_stream")
+	_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "100", Value: -1}, {Key: "UserID", Value: 1}},
+	})
+	require.NoError(t, err)
+	err = insertTestValue(collection)
+	require.NoError(t, err)
+
+	stream, err := StreamRatings(context.TODO(), collection, DefaultRatingSchema, StreamOptions{
+		Limit:     10,
+		BatchSize: 3,
+		Hint:      bson.D{{Key: "100", Value: -1}, {Key: "UserID", Value: 1}},
+	})
+	require.NoError(t, err)
+
+	var count int64
+	for stream.Next(context.TODO()) {
+		count++
+		require.Equal(t, count, stream.Item().Rank)
+		require.Equal(t, 1000-count, stream.Item().UserID)
+		require.Equal(t, 1000-count, stream.Item().Value)
+	}
+	require.NoError(t, stream.Err())
+	require.NoError(t, stream.Close(context.TODO()))
+	require.Equal(t, int64(10), count)
+}
+
+// тест чтения коллекции с нестандартной схемой
+func TestGetRatingsSchema(t *testing.T) {
+	collection := mongoCollection.Database().Collection("rating_schema")
+	docs := []interface{}{
+		bson.M{"user": bson.M{"id": 1}, "score": 10, "reached": 300, "season": "s1"},
+		bson.M{"user": bson.M{"id": 2}, "score": 10, "reached": 100, "season": "s1"},
+		bson.M{"user": bson.M{"id": 3}, "score": 50, "reached": 200, "season": "s1"},
+		bson.M{"user": bson.M{"id": 4}, "score": 99, "reached": 100, "season": "s2"},
+	}
+	_, err := collection.InsertMany(context.TODO(), docs)
+	require.NoError(t, err)
+
+	rating, _, err := GetRatings(context.TODO(), collection, RatingSchema{
+		UserField:     "user.id",
+		ScoreField:    "score",
+		TieBreakField: "reached",
+		Filter:        bson.M{"season": "s1"},
+	}, ReadOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []*RankedUser{
+		{Rank: 1, UserID: 3, Value: 50},
+		{Rank: 2, UserID: 2, Value: 10},
+		{Rank: 3, UserID: 1, Value: 10},
+	}, rating)
+}
+
+// битые документы либо пропускаются с подсчётом, либо дают ошибку
+func TestGetRatingsBadDocuments(t *testing.T) {
+	collection := mongoCollection.Database().Collection("rating_bad")
+	docs := []interface{}{
+		bson.M{"UserID": 1, "100": 10},
+		bson.M{"UserID": 2, "100": "broken"},
+		bson.M{"UserID": 3},
+	}
+	_, err := collection.InsertMany(context.TODO(), docs)
+	require.NoError(t, err)
+
+	_, _, err = GetRatings(context.TODO(), collection, DefaultRatingSchema, ReadOptions{})
+	require.Error(t, err)
+
+	rating, skipped, err := GetRatings(context.TODO(), collection, DefaultRatingSchema, ReadOptions{SkipBadDocuments: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, skipped)
+	require.Equal(t, []*RankedUser{{Rank: 1, UserID: 1, Value: 10}}, rating)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, _, err = GetRatings(ctx, collection, DefaultRatingSchema, ReadOptions{})
+	require.Error(t, err)
+}
+
+// рейтинг по сумме платежей за сутки из сырых событий
+func TestAggregateRatings(t *testing.T) {
+	collection := mongoCollection.Database().Collection("rating_events")
+	day := time.Date(2021, 3, 10, 0, 0, 0, 0, time.UTC)
+	docs := []interface{}{
+		bson.M{"UserID": 1, "Amount": 30, "Kind": "payment", "Time": day.Add(time.Hour)},
+		bson.M{"UserID": 1, "Amount": 20, "Kind": "payment", "Time": day.Add(5 * time.Hour)},
+		bson.M{"UserID": 2, "Amount": 50, "Kind": "payment", "Time": day.Add(2 * time.Hour)},
+		bson.M{"UserID": 3, "Amount": 10, "Kind": "payment", "Time": day.Add(3 * time.Hour)},
+		bson.M{"UserID": 3, "Amount": 100, "Kind": "like", "Time": day.Add(3 * time.Hour)},
+		bson.M{"UserID": 4, "Amount": 500, "Kind": "payment", "Time": day.Add(-time.Hour)},
+	}
+	_, err := collection.InsertMany(context.TODO(), docs)
+	require.NoError(t, err)
+
+	rating, skipped, err := AggregateRatings(context.TODO(), collection, EventsSchema{
+		UserField:  "UserID",
+		TimeField:  "Time",
+		ValueField: "Amount",
+		Filter:     bson.M{"Kind": "payment"},
+	}, DailyWindow(day.Add(12*time.Hour)), ReadOptions{})
+	require.NoError(t, err)
+	require.Zero(t, skipped)
+	require.Equal(t, []*RankedUser{
+		{Rank: 1, UserID: 2, Value: 50},
+		{Rank: 2, UserID: 1, Value: 50},
+		{Rank: 3, UserID: 3, Value: 10},
+	}, rating)
+}
+
+func TestWindows(t *testing.T) {
+	// среда
+	now := time.Date(2021, 3, 10, 15, 30, 0, 0, time.UTC)
+	require.Equal(t, Window{
+		From: time.Date(2021, 3, 10, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 3, 11, 0, 0, 0, 0, time.UTC),
+	}, DailyWindow(now))
+	require.Equal(t, Window{
+		From: time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC),
+	}, WeeklyWindow(now))
+	require.Equal(t, Window{
+		From: time.Date(2021, 3, 3, 15, 30, 0, 0, time.UTC),
+		To:   now,
+	}, RollingWindow(now, 7*24*time.Hour))
+}
+
+// источники рейтинга, собранные из конфига
+func TestNewRatingSource(t *testing.T) {
+	rating := []*approto.RatingItem{
+		{
+			UserID: proto.Uint32(1),
+			Rank:   proto.Uint32(1),
+			Value:  proto.Int64(100),
+		}, {
+			UserID: proto.Uint32(10),
+			Rank:   proto.Uint32(2),
+			Value:  proto.Int64(50),
+		},
+	}
+	b, err := json.Marshal(rating)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(b)
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "rating")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	deps := SourceDeps{Mongo: mongoCollection.Database(), SQL: sqlPool}
+	for _, cfg := range []RatingSourceConfig{
+		{Type: SourceService, URL: server.URL},
+		{Type: SourceFile, Path: file.Name()},
+	} {
+		source, err := NewRatingSource(cfg, deps)
+		require.NoError(t, err)
+		actual, err := source.GetRating(context.TODO())
+		require.NoError(t, err, cfg.Type)
+		require.Equal(t, rating, actual, cfg.Type)
+	}
+
+	source, err := NewRatingSource(RatingSourceConfig{Type: SourceMongo, Collection: "rating_schema"}, deps)
+	require.NoError(t, err)
+	require.IsType(t, &MongoRatingSource{}, source)
+
+	_, err = NewRatingSource(RatingSourceConfig{Type: SourceEvents, Window: WindowConfig{Type: "rolling", Rolling: "week"}}, deps)
+	require.Error(t, err)
+	_, err = NewRatingSource(RatingSourceConfig{Type: "unknown"}, deps)
+	require.Error(t, err)
+}
+
+func TestRatingConverter(t *testing.T) {
+	rating, err := RatingConverter([]*RankedUser{
+		{Rank: 1, UserID: 25, Value: 100},
+		{Rank: 2, UserID: math.MaxUint32, Value: -5},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*approto.RatingItem{
+		{
+			UserID: proto.Uint32(25),
+			Rank:   proto.Uint32(1),
+			Value:  proto.Int64(100),
+		}, {
+			UserID: proto.Uint32(math.MaxUint32),
+			Rank:   proto.Uint32(2),
+			Value:  proto.Int64(-5),
+		},
+	}, rating)
+
+	_, err = RatingConverter([]*RankedUser{{Rank: 1, UserID: math.MaxUint32 + 1}})
+	require.Equal(t, ErrOverflow, errors.Cause(err))
+	_, err = RatingConverter([]*RankedUser{{Rank: -1, UserID: 1}})
+	require.Equal(t, ErrOverflow, errors.Cause(err))
+}
+
 func insertTestValue(collection *mongo.Collection) error {
 	for i := 0; i < 1000; i++ {
 		_, err := collection.InsertOne(context.TODO(), bson.M{"100": i, "UserID": i})
@@ -0,0 +1,141 @@
+package ratiing_filter
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	approto "proto"
+)
+
+// Hysteresis подавление дребезга пользователей у границы чанков: переход засчитывается,
+// если пользователь продержался в новом чанке Runs запусков подряд или зашёл за границу минимум на Places мест
+type Hysteresis struct {
+	Runs int
+	// Places 0 - правило по местам не используется
+	Places int
+}
+
+// PendingChange неподтверждённый переход пользователя, хранится рядом со снапшотом
+type PendingChange struct {
+	// Chunk последний чанк, о котором пользователь получил событие
+	Chunk int
+	// Candidate чанк, в котором пользователь сейчас
+	Candidate int
+	// Runs сколько запусков подряд пользователь в Candidate
+	Runs int
+}
+
+// validateHysteresis без PendingFetcher и PendingSaver гистерезис не может хранить неподтверждённые переходы
+func (s ScopeEvent) validateHysteresis() error {
+	if s.Hysteresis != nil && (s.PendingFetcher == nil || s.PendingSaver == nil) {
+		return errors.New("hysteresis requires PendingFetcher and PendingSaver")
+	}
+	return nil
+}
+
+// suppress применяем гистерезис к событиям, возвращаем новое состояние неподтверждённых переходов
+func (s ScopeEvent) suppress(ctx context.Context, events []Event, current map[uint32]int, filteredRating []*approto.RatingItem) ([]Event, map[uint32]PendingChange, error) {
+	if s.Hysteresis == nil {
+		return events, nil, nil
+	}
+	ctx, st := startStage(ctx, s.Logger, "hysteresis")
+	pending, err := runPolicy(ctx, s.Timeouts.Fetch, s.Policies.Fetch, s.PendingFetcher)
+	if errors.Cause(err) == ErrNotFound {
+		pending = nil
+	} else if err != nil {
+		err = errors.WithMessage(err, "cannot fetch pending changes")
+		st.end(ctx, err)
+		return nil, nil, err
+	}
+
+	ranks := make(map[uint32]int, len(filteredRating))
+	for idx, item := range filteredRating {
+		ranks[item.GetUserID()] = idx + 1
+	}
+	created := len(events)
+	events, pending = suppressFlapping(events, current, ranks, pending, s.Chunks, *s.Hysteresis)
+	st.end(ctx, nil, "created", created, "confirmed", len(events), "pending", len(pending))
+	return events, pending, nil
+}
+
+// savePending сохраняем состояние после сохранения снапшота, чтобы они не разошлись
+func (s ScopeEvent) savePending(ctx context.Context, pending map[uint32]PendingChange) error {
+	if s.Hysteresis == nil {
+		return nil
+	}
+	_, err := runPolicy(ctx, s.Timeouts.Save, s.Policies.Save, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.PendingSaver(ctx, pending)
+	})
+	if err != nil {
+		return errors.WithMessage(err, "cannot save pending changes")
+	}
+	return nil
+}
+
+// suppressFlapping в снапшот всегда попадает фактический чанк, поэтому для пользователей с неподтверждённым
+// переходом точкой отсчёта служит PendingChange.Chunk, а не предыдущий снапшот
+func suppressFlapping(events []Event, current, ranks map[uint32]int, pending map[uint32]PendingChange, chunks [][2]int, h Hysteresis) ([]Event, map[uint32]PendingChange) {
+	var result []Event
+	next := make(map[uint32]PendingChange)
+	acknowledged := make(map[uint32]int)
+
+	for _, e := range events {
+		p, isPending := pending[e.UserID]
+		switch e.Event {
+		case MoveUp, MoveDown:
+			acknowledged[e.UserID] = e.PreviousChunk
+			if isPending {
+				acknowledged[e.UserID] = p.Chunk
+			}
+		case Out:
+			if isPending {
+				e.PreviousChunk = p.Chunk
+			}
+			result = append(result, e)
+		default:
+			result = append(result, e)
+		}
+	}
+	// пользователи, застрявшие в новом чанке, событий от createEvents уже не получают
+	for userID, p := range pending {
+		if _, ok := current[userID]; ok {
+			if _, ok := acknowledged[userID]; !ok {
+				acknowledged[userID] = p.Chunk
+			}
+		}
+	}
+
+	for userID, from := range acknowledged {
+		to := current[userID]
+		if to == from {
+			// вернулся обратно, пользователь ничего не заметил
+			continue
+		}
+		runs := 1
+		if p, ok := pending[userID]; ok && p.Candidate == to {
+			runs = p.Runs + 1
+		}
+		if runs < h.Runs && (h.Places <= 0 || crossedBy(ranks[userID], from, to, chunks) < h.Places) {
+			next[userID] = PendingChange{Chunk: from, Candidate: to, Runs: runs}
+			continue
+		}
+
+		kind := MoveUp
+		if to > from {
+			kind = MoveDown
+		}
+		result = append(result, Event{UserID: userID, Event: kind, PreviousChunk: from, CurrentChunk: to})
+	}
+	return result, next
+}
+
+// crossedBy на сколько мест пользователь зашёл за границу нового чанка
+func crossedBy(rank, from, to int, chunks [][2]int) int {
+	if to < 1 || to > len(chunks) {
+		return 0
+	}
+	bounds := chunks[to-1]
+	if to < from {
+		return bounds[1] - rank + 1
+	}
+	return rank - bounds[0] + 1
+}
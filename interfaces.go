@@ -1,7 +1,16 @@
 package interfaces
 
-import  pc "proto-compile"
+import (
+	"context"
+	pc "proto-compile"
+)
 
 type PayerRatingsDict interface {
-	GetReward(place int) *pc.AdmTalkDictPayerRatingData
+	// GetReward возвращает награду за место place в рейтинге из ratingSize участников со значением value
+	GetReward(place, ratingSize int, value int64) *pc.AdmTalkDictPayerRatingData
+}
+
+// RatingSource источник текущего рейтинга, отсортированного по местам
+type RatingSource interface {
+	GetRating(ctx context.Context) ([]*pc.RatingItem, error)
 }
@@ -0,0 +1,294 @@
+// Package jobs описание заданий рейтингов в конфиге и сборка из него scope для rating_filter
+package jobs
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"ratings_filters/helpers"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config файл заданий, общий для ratingctl и демона
+type Config struct {
+	// Env окружение в ключах снапшотов
+	Env   string
+	Redis RedisConfig
+	Mongo MongoConfig
+	MySQL MySQLConfig
+	// Scheduler настройки демона, ratingctl их не использует
+	Scheduler SchedulerConfig
+	Tracing   TracingConfig
+	Jobs      []JobConfig
+}
+
+// SchedulerConfig общие настройки запусков по расписанию
+type SchedulerConfig struct {
+	// Location часовой пояс расписаний, например Europe/Moscow, по умолчанию локальный
+	Location string
+	// MaxConcurrent сколько заданий выполняется одновременно, 0 - без ограничения
+	MaxConcurrent int
+	// LockTTL время блокировки рейтинга в редис, блокировка продлевается пока идёт запуск,
+	// пусто - без распределённой блокировки
+	LockTTL string
+}
+
+type RedisConfig struct {
+	Addr     string
+	Password string
+	// ConnectTimeout таймаут подключения, например "5s", по умолчанию defaultRedisConnectTimeout.
+	// Команды ограничивают таймауты стадий
+	ConnectTimeout string
+}
+
+// defaultRedisConnectTimeout без таймаута недоступный редис держит стадию до таймаута ОС
+const defaultRedisConnectTimeout = 5 * time.Second
+
+func (c RedisConfig) connectTimeout() (time.Duration, error) {
+	if c.ConnectTimeout == "" {
+		return defaultRedisConnectTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.ConnectTimeout)
+	if err != nil {
+		return 0, errors.WithMessage(err, "cannot parse redis connect timeout")
+	}
+	return timeout, nil
+}
+
+type MongoConfig struct {
+	URI      string
+	Database string
+}
+
+type MySQLConfig struct {
+	DSN string
+}
+
+// JobConfig одно задание: откуда берём рейтинг, как фильтруем и делим на чанки,
+// где храним снапшот и куда отдаём события
+type JobConfig struct {
+	Name string
+	// Kind events, rewards или dislikes, по умолчанию events
+	Kind   string
+	Source helpers.RatingSourceConfig
+	Filter FilterConfig
+	Chunks [][2]int
+	Store  StoreConfig
+	Sinks  []SinkConfig
+	// Rewards таблица словаря наград, пусто - у задания нет наград
+	Rewards string
+	// DislikesDate раскладка time.Format колонки date в Talk.user_like для заданий dislikes,
+	// по умолчанию defaultDislikesDate. Формат задаёт схема таблицы, в коде он нигде не описан
+	DislikesDate string
+	Schedule     ScheduleConfig
+}
+
+// defaultDislikesDate день в формате YYYYMMDD, как в DailyPeriod
+const defaultDislikesDate = "20060102"
+
+// dislikesDate день дизлайков day в формате колонки date
+func (c JobConfig) dislikesDate(day time.Time) (int64, error) {
+	layout := c.DislikesDate
+	if layout == "" {
+		layout = defaultDislikesDate
+	}
+	date, err := strconv.ParseInt(day.Format(layout), 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("dislikes date layout %q is not numeric", layout)
+	}
+	return date, nil
+}
+
+// FilterConfig кого не пускаем в рейтинг
+type FilterConfig struct {
+	ExcludeUsers []uint32
+	// MinValue пользователи с меньшим значением отсекаются, 0 - не отсекаем
+	MinValue int64
+}
+
+// StoreConfig где и как хранится снапшот
+type StoreConfig struct {
+	// Period daily, weekly или фиксированный период, например season1, по умолчанию daily
+	Period string
+	// Codec json, proto или delta, с суффиксом +zstd или +snappy снапшот сжимается
+	Codec string
+	// TTL время жизни снапшота, например "720h"
+	TTL string
+	// ChunkMap хранить только карту чанков вместо всего рейтинга
+	ChunkMap bool
+}
+
+// SinkConfig куда отдаём события, используются только поля его типа
+type SinkConfig struct {
+	Type string
+	// redis_stream
+	Stream string
+	// MaxLen длина стрима redis_stream или истории user_events
+	MaxLen int64
+	// TTL user_events, например "720h", пусто - история не истекает
+	TTL string
+	// kafka
+	Brokers []string
+	Topic   string
+	// webhook
+	URL    string
+	Secret string
+	// file
+	Path string
+}
+
+func (c SinkConfig) ttl() (time.Duration, error) {
+	if c.TTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil {
+		return 0, errors.WithMessage(err, "cannot parse sink ttl")
+	}
+	return ttl, nil
+}
+
+// LoadConfig читает и проверяет JSON файл заданий
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot read config")
+	}
+	cfg := &Config{}
+	err = json.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot unmarshal config")
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate проверяет то, что иначе всплывёт только при запуске задания
+func (c *Config) Validate() error {
+	names := make(map[string]bool, len(c.Jobs))
+	for _, job := range c.Jobs {
+		if job.Name == "" || strings.ContainsAny(job.Name, ":*?[]") {
+			return errors.Errorf("invalid job name %q", job.Name)
+		}
+		if names[job.Name] {
+			return errors.Errorf("duplicated job %q", job.Name)
+		}
+		names[job.Name] = true
+
+		var err error
+		if job.Kind == "" || job.Kind == KindEvents {
+			err = validateChunks(job.Chunks)
+			if err != nil {
+				return errors.WithMessagef(err, "job %q", job.Name)
+			}
+		}
+		_, err = job.Store.options()
+		if err != nil {
+			return errors.WithMessagef(err, "job %q", job.Name)
+		}
+		_, err = job.Schedule.schedule()
+		if err != nil {
+			return errors.WithMessagef(err, "job %q", job.Name)
+		}
+		_, err = job.dislikesDate(time.Time{})
+		if err != nil {
+			return errors.WithMessagef(err, "job %q", job.Name)
+		}
+		switch job.Kind {
+		case "", KindEvents, KindRewards, KindDislikes:
+		default:
+			return errors.Errorf("job %q has unknown kind %q", job.Name, job.Kind)
+		}
+	}
+	_, err := c.Scheduler.location()
+	if err != nil {
+		return err
+	}
+	_, err = c.Scheduler.lockTTL()
+	if err != nil {
+		return err
+	}
+	_, err = c.Redis.connectTimeout()
+	if err != nil {
+		return err
+	}
+	return c.Tracing.validate()
+}
+
+// validateChunks чанки идут по возрастанию мест и не пересекаются
+func validateChunks(chunks [][2]int) error {
+	if len(chunks) == 0 {
+		return errors.New("no chunks")
+	}
+	previous := 0
+	for _, bounds := range chunks {
+		if bounds[0] <= previous || bounds[1] < bounds[0] {
+			return errors.Errorf("invalid chunk %d-%d", bounds[0], bounds[1])
+		}
+		previous = bounds[1]
+	}
+	return nil
+}
+
+// Job задание по имени
+func (c *Config) Job(name string) (JobConfig, error) {
+	for _, job := range c.Jobs {
+		if job.Name == name {
+			return job, nil
+		}
+	}
+	return JobConfig{}, errors.Errorf("unknown job %q", name)
+}
+
+// Key ключ снапшота задания на момент now
+func (c *Config) Key(job JobConfig, now time.Time) helpers.RatingKey {
+	return helpers.RatingKey{Env: c.Env, Name: job.Name, Period: job.Store.period(now)}
+}
+
+func (c StoreConfig) period(now time.Time) string {
+	switch c.Period {
+	case "", "daily":
+		return helpers.DailyPeriod(now)
+	case "weekly":
+		return helpers.WeeklyPeriod(now)
+	}
+	return c.Period
+}
+
+func (c StoreConfig) options() (helpers.SnapshotOptions, error) {
+	var opts helpers.SnapshotOptions
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return opts, errors.WithMessage(err, "cannot parse snapshot ttl")
+		}
+		opts.TTL = ttl
+	}
+
+	name, compression, _ := strings.Cut(c.Codec, "+")
+	switch name {
+	case "", "json":
+		opts.Codec = helpers.JSONCodec
+	case "proto":
+		opts.Codec = helpers.ProtoCodec
+	case "delta":
+		opts.Codec = helpers.DeltaCodec
+	default:
+		return opts, errors.Errorf("unknown snapshot codec %q", c.Codec)
+	}
+	switch compression {
+	case "":
+	case "zstd":
+		opts.Codec = helpers.ZstdCodec(opts.Codec)
+	case "snappy":
+		opts.Codec = helpers.SnappyCodec(opts.Codec)
+	default:
+		return opts, errors.Errorf("unknown snapshot compression %q", compression)
+	}
+	return opts, nil
+}
@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	approto "proto"
+	"ratings_filters/helpers"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"Env": "develop",
+		"Jobs": [{
+			"Name": "likes",
+			"Source": {"Type": "file", "Path": "likes.json"},
+			"Filter": {"ExcludeUsers": [7], "MinValue": 10},
+			"Chunks": [[1, 10], [11, 100]],
+			"Store": {"Period": "weekly", "Codec": "delta+zstd", "TTL": "720h"},
+			"Sinks": [{"Type": "file", "Path": "events.jsonl"}]
+		}]
+	}`), 0644)
+	require.NoError(t, err)
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	job, err := cfg.Job("likes")
+	require.NoError(t, err)
+	_, err = cfg.Job("dislikes")
+	require.Error(t, err)
+
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, helpers.RatingKey{Env: "develop", Name: "likes", Period: "2021W10"}, cfg.Key(job, now))
+	opts, err := job.Store.options()
+	require.NoError(t, err)
+	require.Equal(t, 720*time.Hour, opts.TTL)
+
+	filter := job.Filter.filter()
+	require.True(t, filter(&approto.RatingItem{UserID: proto.Uint32(7), Value: proto.Int64(100)}))
+	require.True(t, filter(&approto.RatingItem{UserID: proto.Uint32(8), Value: proto.Int64(5)}))
+	require.False(t, filter(&approto.RatingItem{UserID: proto.Uint32(8), Value: proto.Int64(10)}))
+
+	_, err = Processor(job, cfg.Env, Deps{})
+	require.NoError(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	job := JobConfig{Name: "likes", Chunks: [][2]int{{1, 10}, {11, 100}}}
+	require.NoError(t, (&Config{Jobs: []JobConfig{job}}).Validate())
+	require.Error(t, (&Config{Jobs: []JobConfig{job, job}}).Validate())
+	require.Error(t, (&Config{Redis: RedisConfig{ConnectTimeout: "soon"}, Jobs: []JobConfig{job}}).Validate())
+
+	invalid := []JobConfig{
+		{Name: "a:b", Chunks: job.Chunks},
+		{Name: "likes"},
+		{Name: "likes", Chunks: [][2]int{{1, 10}, {5, 100}}},
+		{Name: "likes", Chunks: job.Chunks, Store: StoreConfig{Codec: "xml"}},
+		{Name: "likes", Chunks: job.Chunks, Store: StoreConfig{Codec: "json+gzip"}},
+		{Name: "likes", Chunks: job.Chunks, Store: StoreConfig{TTL: "month"}},
+		{Name: "dislikes", Kind: KindDislikes, DislikesDate: "2006-01-02"},
+	}
+	for idx, job := range invalid {
+		require.Error(t, (&Config{Jobs: []JobConfig{job}}).Validate(), idx)
+	}
+}
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"mysql"
+	"net/http"
+	"ratings_filters/helpers"
+	"time"
+)
+
+// httpTimeout таймаут запросов к сервисам рейтинга и вебхукам
+const httpTimeout = 30 * time.Second
+
+// tickTTL сколько помним выполненный тик: дольше, чем другой инстанс может опоздать с тем же тиком
+const tickTTL = 48 * time.Hour
+
+// Connect подключаемся только к тому, что описано в конфиге, closeAll закрывает подключения
+// и вызывается даже при ошибке
+func Connect(ctx context.Context, cfg *Config) (deps Deps, closeAll func(), err error) {
+	connectTimeout, err := cfg.Redis.connectTimeout()
+	if err != nil {
+		return deps, func() {}, err
+	}
+	deps = Deps{
+		Redis: redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Redis.Addr, redis.DialPassword(cfg.Redis.Password),
+					redis.DialConnectTimeout(connectTimeout))
+			},
+		},
+	}
+	deps.Sources.HTTP = &http.Client{Timeout: httpTimeout}
+	lockTTL, err := cfg.Scheduler.lockTTL()
+	if err != nil {
+		return deps, func() {}, err
+	}
+	if lockTTL > 0 {
+		deps.Locker = &helpers.RedisLocker{Pool: deps.Redis, TTL: lockTTL}
+		deps.MarkTick = func(ctx context.Context, job string, tick time.Time) (bool, error) {
+			return helpers.MarkTick(ctx, deps.Redis, helpers.TickKey(cfg.Env, job, tick), tickTTL)
+		}
+	}
+	closers := []func(){}
+	closeAll = func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+
+	shutdownTracing, err := SetupTracing(ctx, cfg.Tracing)
+	if err != nil {
+		return deps, closeAll, err
+	}
+	closers = append(closers, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		_ = shutdownTracing(shutdownCtx)
+	})
+
+	if cfg.Mongo.URI != "" {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Mongo.URI))
+		if err != nil {
+			return deps, closeAll, errors.WithMessage(err, "cannot connect to mongo")
+		}
+		closers = append(closers, func() {
+			_ = client.Disconnect(context.Background())
+		})
+		deps.Sources.Mongo = client.Database(cfg.Mongo.Database)
+	}
+	if cfg.MySQL.DSN != "" {
+		pool, err := mysql.NewConnectionsPool(cfg.MySQL.DSN)
+		if err != nil {
+			return deps, closeAll, errors.WithMessage(err, "cannot connect to mysql")
+		}
+		closers = append(closers, func() {
+			pool.Close()
+		})
+		deps.Sources.SQL = pool
+	}
+
+	for _, job := range cfg.Jobs {
+		for _, sink := range job.Sinks {
+			key := kafkaWriterKey(sink)
+			if sink.Type != SinkKafka || deps.Kafka[key] != nil {
+				continue
+			}
+			if deps.Kafka == nil {
+				deps.Kafka = make(map[string]*kafka.Writer)
+			}
+			writer := &kafka.Writer{Addr: kafka.TCP(sink.Brokers...), Topic: sink.Topic}
+			closers = append(closers, func() {
+				_ = writer.Close()
+			})
+			deps.Kafka[key] = writer
+		}
+	}
+	return deps, closeAll, nil
+}
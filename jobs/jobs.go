@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"log/slog"
+	approto "proto"
+	"ratings_filters/helpers"
+	"ratings_filters/interfaces"
+	r "ratings_filters/rating_filter"
+	"strings"
+	"time"
+)
+
+// типы получателей событий в SinkConfig.Type
+const (
+	SinkRedisStream = "redis_stream"
+	SinkKafka       = "kafka"
+	SinkWebhook     = "webhook"
+	SinkFile        = "file"
+	// SinkUserEvents история последних событий каждого пользователя для админки
+	SinkUserEvents = "user_events"
+)
+
+// Deps подключения, из которых собираются задания
+type Deps struct {
+	Redis   redis.Pool
+	Sources helpers.SourceDeps
+	// Locker блокировка запусков по ключу рейтинга, nil - без блокировки
+	Locker r.Locker
+	// MarkTick отмечает тик расписания задания выполненным, false - тик уже выполнил другой инстанс,
+	// nil - тики не отмечаются
+	MarkTick func(ctx context.Context, job string, tick time.Time) (bool, error)
+	// Payout выплата наград заданий rewards и dislikes, nil - награды только считаются
+	Payout func(ctx context.Context, job string, rewards []*r.RewardUser) error
+	// Logger общий логгер заданий, nil - slog.Default()
+	Logger *slog.Logger
+	// Kafka писатели получателей kafka по kafkaWriterKey, создаются и закрываются в Connect
+	Kafka map[string]*kafka.Writer
+}
+
+// kafkaWriterKey один писатель на пару брокеры и топик
+func kafkaWriterKey(cfg SinkConfig) string {
+	return strings.Join(cfg.Brokers, ",") + "/" + cfg.Topic
+}
+
+func (d Deps) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.Default()
+	}
+	return d.Logger
+}
+
+// Source источник текущего рейтинга задания
+func Source(job JobConfig, deps Deps) (interfaces.RatingSource, error) {
+	source, err := helpers.NewRatingSource(job.Source, deps.Sources)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "job %q", job.Name)
+	}
+	return source, nil
+}
+
+// EventScope scope для GetEvent, снапшот задания хранится под key
+func EventScope(job JobConfig, key helpers.RatingKey, deps Deps) (r.ScopeEvent, error) {
+	opts, err := job.Store.options()
+	if err != nil {
+		return r.ScopeEvent{}, err
+	}
+	processor, err := Processor(job, key.Env, deps)
+	if err != nil {
+		return r.ScopeEvent{}, err
+	}
+
+	scope := r.ScopeEvent{
+		Name:            job.Name,
+		EventsProcessor: processor,
+		RatingFilter:    job.Filter.filter(),
+		Chunks:          job.Chunks,
+		Locker:          deps.Locker,
+		LockKey:         key.LockKey(),
+		Logger:          deps.logger().With("key", key.String()),
+	}
+	if job.Store.ChunkMap {
+		scope.ChunkFetcher = func(ctx context.Context, current map[uint32]int) (map[uint32]int, error) {
+			return helpers.GetPreviousChunks(ctx, deps.Redis, key, current)
+		}
+		scope.ChunkSaver = func(ctx context.Context, changed map[uint32]int, removed []uint32) error {
+			return helpers.SaveChunkMap(ctx, deps.Redis, key, changed, removed, opts)
+		}
+		return scope, nil
+	}
+	scope.RatingFetcher = func(ctx context.Context) ([]*approto.RatingItem, error) {
+		return helpers.GetPreviousRating(ctx, deps.Redis, key)
+	}
+	scope.RatingSaver = func(ctx context.Context, rating []*approto.RatingItem) error {
+		return helpers.SaveRating(ctx, deps.Redis, key, rating, opts)
+	}
+	return scope, nil
+}
+
+// RewardScope scope для GetRewardUsers со словарём наград задания
+func RewardScope(job JobConfig, deps Deps) (r.ScopeDislikeReward, error) {
+	dict, err := Dict(job, deps)
+	if err != nil {
+		return r.ScopeDislikeReward{}, err
+	}
+	scope := r.ScopeDislikeReward{
+		Name:         job.Name,
+		RatingFilter: job.Filter.filter(),
+		PayerRatings: dict,
+		Logger:       deps.logger(),
+	}
+	if deps.Payout != nil {
+		scope.RewardsProcessor = func(ctx context.Context, rewards []*r.RewardUser) error {
+			return deps.Payout(ctx, job.Name, rewards)
+		}
+	}
+	return scope, nil
+}
+
+// Dict словарь наград задания, перед использованием проверяется
+func Dict(job JobConfig, deps Deps) (interfaces.PayerRatingsDict, error) {
+	if job.Rewards == "" {
+		return nil, errors.Errorf("job %q has no rewards", job.Name)
+	}
+	if deps.Sources.SQL == nil {
+		return nil, errors.New("rewards require sql pool")
+	}
+	dict, err := helpers.NewDictPayerRatings(deps.Sources.SQL, job.Rewards)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot load reward dictionary")
+	}
+	err = dict.Validate()
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid reward dictionary")
+	}
+	return dict, nil
+}
+
+// Processor все получатели событий задания, вызываются параллельно, env - окружение истории пользователей
+func Processor(job JobConfig, env string, deps Deps) (func(ctx context.Context, e []r.Event) error, error) {
+	if len(job.Sinks) == 0 {
+		return nil, errors.Errorf("job %q has no sinks", job.Name)
+	}
+	var sinks []func(ctx context.Context, e []r.Event) error
+	for _, cfg := range job.Sinks {
+		sink, err := newSink(cfg, env, job.Name, deps)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "job %q", job.Name)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return helpers.FanOutSink(sinks...), nil
+}
+
+func newSink(cfg SinkConfig, env, rating string, deps Deps) (func(ctx context.Context, e []r.Event) error, error) {
+	switch cfg.Type {
+	case SinkRedisStream:
+		return helpers.RedisStreamSink(deps.Redis, cfg.Stream, rating, cfg.MaxLen), nil
+	case SinkKafka:
+		writer, ok := deps.Kafka[kafkaWriterKey(cfg)]
+		if !ok {
+			return nil, errors.Errorf("kafka writer for topic %q is not connected", cfg.Topic)
+		}
+		return helpers.KafkaSink(writer, rating), nil
+	case SinkWebhook:
+		return helpers.WebhookSink(cfg.URL, []byte(cfg.Secret), deps.Sources.HTTP, rating), nil
+	case SinkFile:
+		return helpers.FileSink(cfg.Path, rating), nil
+	case SinkUserEvents:
+		ttl, err := cfg.ttl()
+		if err != nil {
+			return nil, err
+		}
+		return helpers.UserEventsSink(deps.Redis, env, rating, cfg.MaxLen, ttl), nil
+	}
+	return nil, errors.Errorf("unknown sink %q", cfg.Type)
+}
+
+// filter RatingFilter по конфигу, true - пользователь в рейтинг не попадает
+func (c FilterConfig) filter() func(item *approto.RatingItem) bool {
+	excluded := make(map[uint32]bool, len(c.ExcludeUsers))
+	for _, userID := range c.ExcludeUsers {
+		excluded[userID] = true
+	}
+	return func(item *approto.RatingItem) bool {
+		if excluded[item.GetUserID()] {
+			return true
+		}
+		return c.MinValue != 0 && item.GetValue() < c.MinValue
+	}
+}
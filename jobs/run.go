@@ -0,0 +1,62 @@
+package jobs
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"ratings_filters/helpers"
+	"ratings_filters/interfaces"
+	r "ratings_filters/rating_filter"
+	"time"
+)
+
+// типы заданий в JobConfig.Kind
+const (
+	// KindEvents события переходов между чанками через GetEvent
+	KindEvents = "events"
+	// KindRewards награды по текущему рейтингу источника
+	KindRewards = "rewards"
+	// KindDislikes награды по дизлайкам за прошедшие сутки, источник задания не используется
+	KindDislikes = "dislikes"
+)
+
+// Run один запуск задания на момент now
+func Run(ctx context.Context, cfg *Config, job JobConfig, deps Deps, now time.Time) error {
+	switch job.Kind {
+	case "", KindEvents:
+		scope, err := EventScope(job, cfg.Key(job, now), deps)
+		if err != nil {
+			return err
+		}
+		source, err := Source(job, deps)
+		if err != nil {
+			return err
+		}
+		_, err = r.GetEventFromSource(ctx, source, scope)
+		return err
+	case KindRewards, KindDislikes:
+		scope, err := RewardScope(job, deps)
+		if err != nil {
+			return err
+		}
+		source, err := RewardSource(job, deps, now)
+		if err != nil {
+			return err
+		}
+		_, err = r.GetRewardUsersFromSource(ctx, source, scope)
+		return err
+	}
+	return errors.Errorf("unknown job kind %q", job.Kind)
+}
+
+// RewardSource рейтинг, по которому задание rewards или dislikes на момент now считает награды:
+// dislikes берёт дизлайки за прошедшие сутки, rewards - источник задания
+func RewardSource(job JobConfig, deps Deps, now time.Time) (interfaces.RatingSource, error) {
+	if job.Kind != KindDislikes {
+		return Source(job, deps)
+	}
+	date, err := job.dislikesDate(now.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	return &helpers.DislikesRatingSource{Pool: deps.Sources.SQL, Date: date}, nil
+}
@@ -0,0 +1,340 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	r "ratings_filters/rating_filter"
+	"sync"
+	"time"
+)
+
+// unlockTimeout сколько ждём снятия блокировки задания после его завершения
+const unlockTimeout = 5 * time.Second
+
+// ScheduleConfig когда запускать задание, задаётся не больше одного поля, пустое - только вручную
+type ScheduleConfig struct {
+	// Cron выражение из 5 полей, например "*/15 * * * *"
+	Cron string
+	// Every интервал между запусками, например "10m"
+	Every string
+	// EndOfDay время после полуночи "00:10", задание dislikes получает прошедшие сутки
+	EndOfDay string
+	// Timeout ограничение на один запуск, например "5m"
+	Timeout string
+}
+
+func (c ScheduleConfig) schedule() (cron.Schedule, error) {
+	set := 0
+	for _, v := range []string{c.Cron, c.Every, c.EndOfDay} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one of Cron, Every and EndOfDay can be set")
+	}
+	if c.Timeout != "" {
+		_, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse schedule timeout")
+		}
+	}
+
+	switch {
+	case c.Cron != "":
+		schedule, err := cron.ParseStandard(c.Cron)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse cron")
+		}
+		return schedule, nil
+	case c.Every != "":
+		every, err := time.ParseDuration(c.Every)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse interval")
+		}
+		if every < time.Second {
+			return nil, errors.Errorf("interval %s is shorter than a second", every)
+		}
+		return cron.Every(every), nil
+	case c.EndOfDay != "":
+		at, err := time.Parse("15:04", c.EndOfDay)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse end of day time")
+		}
+		return cron.ParseStandard(fmt.Sprintf("%d %d * * *", at.Minute(), at.Hour()))
+	}
+	return nil, nil
+}
+
+func (c ScheduleConfig) timeout() time.Duration {
+	// формат проверен в schedule
+	timeout, _ := time.ParseDuration(c.Timeout)
+	return timeout
+}
+
+func (c SchedulerConfig) location() (*time.Location, error) {
+	if c.Location == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.Location)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot load scheduler location")
+	}
+	return loc, nil
+}
+
+func (c SchedulerConfig) lockTTL() (time.Duration, error) {
+	if c.LockTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(c.LockTTL)
+	if err != nil {
+		return 0, errors.WithMessage(err, "cannot parse lock ttl")
+	}
+	return ttl, nil
+}
+
+var tracer = otel.Tracer("ratings_filters/jobs")
+
+var (
+	// ErrJobRunning задание уже выполняется в этом инстансе
+	ErrJobRunning = errors.New("job is already running")
+	// ErrSchedulerStopped планировщик не запущен или остановлен
+	ErrSchedulerStopped = errors.New("scheduler is not running")
+)
+
+// Scheduler запускает задания конфига по расписанию: запуски одного задания не пересекаются,
+// одновременно выполняется не больше MaxConcurrent заданий, с Deps.Locker задание
+// выполняет только один инстанс
+type Scheduler struct {
+	cfg  *Config
+	deps Deps
+	loc  *time.Location
+	cron *cron.Cron
+	// slots свободные места для заданий, nil - без ограничения
+	slots chan struct{}
+	// run запуск задания, в тестах подменяется
+	run func(ctx context.Context, job JobConfig, now time.Time) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// running задания, выполняющиеся сейчас, по расписанию или через Trigger
+	running map[string]bool
+	stopped bool
+	// triggered запуски через Trigger, cron.Stop их не ждёт
+	triggered sync.WaitGroup
+}
+
+func NewScheduler(cfg *Config, deps Deps) (*Scheduler, error) {
+	loc, err := cfg.Scheduler.location()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := cron.PrintfLogger(slog.NewLogLogger(deps.logger().Handler(), slog.LevelInfo))
+	s := &Scheduler{
+		cfg:  cfg,
+		deps: deps,
+		loc:  loc,
+		cron: cron.New(
+			cron.WithLocation(loc),
+			cron.WithLogger(logger),
+			cron.WithChain(cron.Recover(logger), cron.SkipIfStillRunning(logger)),
+		),
+		running: make(map[string]bool),
+	}
+	s.run = func(ctx context.Context, job JobConfig, now time.Time) error {
+		return Run(ctx, s.cfg, job, s.deps, now)
+	}
+	if cfg.Scheduler.MaxConcurrent > 0 {
+		s.slots = make(chan struct{}, cfg.Scheduler.MaxConcurrent)
+	}
+
+	for _, job := range cfg.Jobs {
+		schedule, err := job.Schedule.schedule()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "job %q", job.Name)
+		}
+		if schedule == nil {
+			continue
+		}
+		job := job
+		s.cron.Schedule(schedule, cron.FuncJob(func() {
+			s.runJob(job, time.Now().In(loc).Truncate(time.Minute))
+		}))
+	}
+	return s, nil
+}
+
+// Start запускает расписание, ctx отменяет выполняющиеся задания
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.mu.Unlock()
+	s.cron.Start()
+}
+
+// Stop новые запуски прекращаются, выполняющиеся дожидаемся до отмены ctx,
+// после чего отменяем их контекст
+func (s *Scheduler) Stop(ctx context.Context) {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	stopped := s.cron.Stop()
+	done := make(chan struct{})
+	go func() {
+		<-stopped.Done()
+		s.triggered.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+	}
+	s.cancel()
+}
+
+// Trigger внеочередной запуск задания в фоне, возвращает ID запуска для поиска в логах и трейсах
+func (s *Scheduler) Trigger(name string) (runID string, err error) {
+	job, err := s.cfg.Job(name)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil || s.stopped {
+		return "", ErrSchedulerStopped
+	}
+	if s.running[name] {
+		return "", ErrJobRunning
+	}
+	s.running[name] = true
+	s.triggered.Add(1)
+
+	runID = r.NewRunID()
+	go func() {
+		defer s.triggered.Done()
+		defer s.finish(name)
+		s.execute(job, runID, time.Time{})
+	}()
+	return runID, nil
+}
+
+// start отмечаем задание выполняющимся, false - оно уже выполняется
+func (s *Scheduler) start(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[name] {
+		return false
+	}
+	s.running[name] = true
+	return true
+}
+
+func (s *Scheduler) finish(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, name)
+}
+
+// runJob запуск по расписанию на тике tick, пропускаем, если задание запущено через Trigger
+func (s *Scheduler) runJob(job JobConfig, tick time.Time) {
+	if !s.start(job.Name) {
+		s.deps.logger().Info("job skipped, already running", "job", job.Name)
+		return
+	}
+	defer s.finish(job.Name)
+	s.execute(job, r.NewRunID(), tick)
+}
+
+// execute ждём свободного места и блокировку, затем выполняем задание. Награды по тику
+// расписания выплачивает только первый взявший его инстанс, tick нулевой у запусков через Trigger
+func (s *Scheduler) execute(job JobConfig, runID string, tick time.Time) {
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+
+	now := time.Now().In(s.loc)
+	ctx := r.WithRunID(s.ctx, runID)
+	logger := s.deps.logger().With("job", job.Name, "run_id", runID)
+	if timeout := job.Schedule.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// события GetEvent блокирует сам, остальные задания блокируем здесь
+	if s.deps.Locker != nil && job.Kind != "" && job.Kind != KindEvents {
+		lockKey := s.cfg.Key(job, now).LockKey()
+		lock, err := s.deps.Locker.Lock(ctx, lockKey)
+		if errors.Cause(err) == r.ErrLocked {
+			logger.InfoContext(ctx, "job skipped, locked by another instance", "key", lockKey)
+			return
+		} else if err != nil {
+			logger.ErrorContext(ctx, "cannot lock job", "key", lockKey, "error", err)
+			return
+		}
+		ctx = r.WithFencingToken(ctx, lock.Token())
+		defer func() {
+			// снимаем блокировку даже после отмены контекста задания, но не ждём вечно
+			unlockCtx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+			defer cancel()
+			err := lock.Unlock(unlockCtx)
+			if err != nil {
+				logger.ErrorContext(ctx, "cannot unlock job", "key", lockKey, "error", err)
+			}
+		}()
+
+		// блокировка не даёт запускам пересечься, но после её снятия другой инстанс
+		// выполнил бы тот же тик ещё раз и выплатил награды повторно
+		if s.deps.MarkTick != nil && !tick.IsZero() {
+			marked, err := s.deps.MarkTick(ctx, job.Name, tick)
+			if err != nil {
+				logger.ErrorContext(ctx, "cannot mark tick", "tick", tick, "error", err)
+				return
+			}
+			if !marked {
+				logger.InfoContext(ctx, "job skipped, tick done by another instance", "tick", tick)
+				return
+			}
+		}
+	}
+
+	ctx, span := tracer.Start(ctx, "job", trace.WithAttributes(
+		attribute.String("job.name", job.Name),
+		attribute.String("job.kind", job.Kind),
+		attribute.String("job.run_id", runID),
+	))
+	defer span.End()
+
+	started := time.Now()
+	err := s.run(ctx, job, now)
+	if errors.Cause(err) == r.ErrLocked {
+		span.SetAttributes(attribute.Bool("job.skipped", true))
+		logger.InfoContext(ctx, "job skipped, locked by another instance")
+		return
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.ErrorContext(ctx, "job failed", "duration", time.Since(started), "error", err)
+		return
+	}
+	logger.InfoContext(ctx, "job done", "duration", time.Since(started))
+}
@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	r "ratings_filters/rating_filter"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduleConfig(t *testing.T) {
+	from := time.Date(2021, 3, 10, 12, 7, 0, 0, time.UTC)
+	cases := []struct {
+		cfg  ScheduleConfig
+		next time.Time
+	}{
+		{cfg: ScheduleConfig{Cron: "*/15 * * * *"}, next: time.Date(2021, 3, 10, 12, 15, 0, 0, time.UTC)},
+		{cfg: ScheduleConfig{Every: "10m"}, next: time.Date(2021, 3, 10, 12, 17, 0, 0, time.UTC)},
+		{cfg: ScheduleConfig{EndOfDay: "00:10"}, next: time.Date(2021, 3, 11, 0, 10, 0, 0, time.UTC)},
+	}
+	for idx, c := range cases {
+		schedule, err := c.cfg.schedule()
+		require.NoError(t, err, idx)
+		require.Equal(t, c.next, schedule.Next(from), idx)
+	}
+
+	schedule, err := ScheduleConfig{}.schedule()
+	require.NoError(t, err)
+	require.Nil(t, schedule)
+
+	for idx, cfg := range []ScheduleConfig{
+		{Cron: "* * *"},
+		{Every: "100ms"},
+		{EndOfDay: "25:00"},
+		{Cron: "* * * * *", Every: "1m"},
+		{Every: "1m", Timeout: "soon"},
+	} {
+		_, err := cfg.schedule()
+		require.Error(t, err, idx)
+	}
+}
+
+func TestSchedulerMaxConcurrent(t *testing.T) {
+	cfg := &Config{
+		Scheduler: SchedulerConfig{MaxConcurrent: 2},
+		Jobs: []JobConfig{
+			{Name: "a", Schedule: ScheduleConfig{Every: "1h"}},
+			{Name: "b", Schedule: ScheduleConfig{Every: "1h"}},
+			{Name: "c", Schedule: ScheduleConfig{Every: "1h"}},
+			{Name: "d", Schedule: ScheduleConfig{Every: "1h", Timeout: "10ms"}},
+		},
+	}
+	scheduler, err := NewScheduler(cfg, Deps{})
+	require.NoError(t, err)
+	require.Len(t, scheduler.cron.Entries(), 4)
+
+	var running, maxRunning int32
+	var timedOut atomic.Bool
+	scheduler.run = func(ctx context.Context, job JobConfig, _ time.Time) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			timedOut.Store(job.Name == "d")
+		}
+		return ctx.Err()
+	}
+	scheduler.Start(context.Background())
+
+	var wg sync.WaitGroup
+	for _, job := range cfg.Jobs {
+		wg.Add(1)
+		go func(job JobConfig) {
+			defer wg.Done()
+			scheduler.runJob(job, time.Now())
+		}(job)
+	}
+	wg.Wait()
+	scheduler.Stop(context.Background())
+
+	require.Equal(t, int32(2), maxRunning)
+	require.True(t, timedOut.Load())
+}
+
+func TestSchedulerTrigger(t *testing.T) {
+	cfg := &Config{Jobs: []JobConfig{{Name: "a"}}}
+	scheduler, err := NewScheduler(cfg, Deps{})
+	require.NoError(t, err)
+
+	_, err = scheduler.Trigger("a")
+	require.Equal(t, ErrSchedulerStopped, err)
+
+	var runs int32
+	release := make(chan struct{})
+	scheduler.run = func(ctx context.Context, job JobConfig, _ time.Time) error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}
+	scheduler.Start(context.Background())
+
+	runID, err := scheduler.Trigger("a")
+	require.NoError(t, err)
+	require.NotEmpty(t, runID)
+	_, err = scheduler.Trigger("a")
+	require.Equal(t, ErrJobRunning, err)
+	_, err = scheduler.Trigger("b")
+	require.Error(t, err)
+	// запуск по расписанию не пересекается с ручным
+	scheduler.runJob(cfg.Jobs[0], time.Now())
+
+	close(release)
+	scheduler.Stop(context.Background())
+	require.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	_, err = scheduler.Trigger("a")
+	require.Equal(t, ErrSchedulerStopped, err)
+}
+
+func TestSchedulerTickOnce(t *testing.T) {
+	cfg := &Config{Jobs: []JobConfig{{Name: "dislikes", Kind: KindDislikes}}}
+	marked := make(map[time.Time]bool)
+	deps := Deps{
+		Locker: &r.MemoryLocker{},
+		// общая отметка тиков нескольких инстансов
+		MarkTick: func(_ context.Context, _ string, tick time.Time) (bool, error) {
+			if marked[tick] {
+				return false, nil
+			}
+			marked[tick] = true
+			return true, nil
+		},
+	}
+	scheduler, err := NewScheduler(cfg, deps)
+	require.NoError(t, err)
+	var runs int32
+	scheduler.run = func(context.Context, JobConfig, time.Time) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}
+	scheduler.Start(context.Background())
+	defer scheduler.Stop(context.Background())
+
+	// второй инстанс берёт освободившуюся блокировку, но тот же тик не повторяет
+	tick := time.Date(2021, 3, 10, 0, 10, 0, 0, time.UTC)
+	scheduler.runJob(cfg.Jobs[0], tick)
+	scheduler.runJob(cfg.Jobs[0], tick)
+	require.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	scheduler.runJob(cfg.Jobs[0], tick.AddDate(0, 0, 1))
+	require.Equal(t, int32(2), atomic.LoadInt32(&runs))
+}
@@ -0,0 +1,75 @@
+package jobs
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"os"
+	"time"
+)
+
+// экспортёры трейсов
+const (
+	TracingStdout = "stdout"
+	TracingOTLP   = "otlp"
+)
+
+// tracingShutdownTimeout сколько ждём отправки оставшихся спанов при закрытии
+const tracingShutdownTimeout = 5 * time.Second
+
+// TracingConfig куда отправлять трейсы запусков, пустой Exporter - трейсы не пишутся
+type TracingConfig struct {
+	// Exporter stdout для локальной отладки (спаны в stderr) или otlp
+	Exporter string
+	// Endpoint адрес OTLP gRPC коллектора, например localhost:4317
+	Endpoint string
+	// Service имя сервиса в трейсах, по умолчанию ratings_filters
+	Service string
+}
+
+func (c TracingConfig) validate() error {
+	switch c.Exporter {
+	case "", TracingStdout:
+	case TracingOTLP:
+		if c.Endpoint == "" {
+			return errors.New("otlp exporter requires endpoint")
+		}
+	default:
+		return errors.Errorf("unknown tracing exporter %q", c.Exporter)
+	}
+	return nil
+}
+
+// SetupTracing задаём глобальный TracerProvider, shutdown отправляет оставшиеся спаны
+func SetupTracing(ctx context.Context, cfg TracingConfig) (shutdown func(ctx context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "":
+		return func(ctx context.Context) error { return nil }, nil
+	case TracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	case TracingOTLP:
+		exporter, err = otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(cfg.Endpoint), otlptracegrpc.WithInsecure())
+	default:
+		return nil, errors.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot create trace exporter")
+	}
+
+	service := cfg.Service
+	if service == "" {
+		service = "ratings_filters"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
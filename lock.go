@@ -0,0 +1,162 @@
+package helpers
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	r "ratings_filters/rating_filter"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acquireLockScript блокировка ставится, только если её нет, значение - следующий fencing token,
+// счётчик токенов живёт отдельно и не истекает вместе с блокировкой
+const acquireLockScript = `if redis.call("EXISTS", KEYS[1]) == 1 then return 0 end
+local token = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], token, "PX", ARGV[1])
+return token`
+
+// renewLockScript продлеваем блокировку, только если она всё ещё наша
+const renewLockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+
+// releaseLockScript снимаем блокировку, только если она всё ещё наша
+const releaseLockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// fenceCheck начало скриптов записи: после нас блокировку рейтинга никто не брал,
+// счётчик токенов KEYS[1] не больше нашего токена ARGV[1], токен 0 - запись без блокировки
+const fenceCheck = `local token = tonumber(ARGV[1])
+if token > 0 then
+	local fence = tonumber(redis.call("GET", KEYS[1]))
+	if fence and fence > token then return redis.error_reply("stale fencing token") end
+end`
+
+// fencedScript команда ARGV[2] над KEYS[2] с проверкой токена
+const fencedScript = fenceCheck + `
+return redis.call(ARGV[2], KEYS[2], unpack(ARGV, 3))`
+
+// ErrStaleToken блокировку рейтинга уже взял более новый запуск, запись отвергнута
+var ErrStaleToken = errors.New("stale fencing token")
+
+// RedisLocker блокировки в редис с fencing token, взятая блокировка продлевается, пока её не снимут
+type RedisLocker struct {
+	Pool redis.Pool
+	TTL  time.Duration
+	// Renew период продления, по умолчанию TTL/3
+	Renew time.Duration
+}
+
+func (l *RedisLocker) Lock(ctx context.Context, key string) (r.Lock, error) {
+	// срок блокировки считаем от запроса, а не от ответа, чтобы не переоценить его
+	expires := time.Now().Add(l.TTL)
+	token, err := redis.Int64(doContext(ctx, l.Pool, "EVAL", acquireLockScript, 2, key, fenceKey(key), l.TTL.Milliseconds()))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot acquire lock")
+	}
+	if token == 0 {
+		return nil, r.ErrLocked
+	}
+
+	renew := l.Renew
+	if renew <= 0 {
+		renew = l.TTL / 3
+	}
+	lock := &redisLock{
+		locker:  l,
+		key:     key,
+		token:   token,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go lock.renew(renew, expires)
+	return lock, nil
+}
+
+// fenceKey счётчик токенов рядом с ключом блокировки рейтинга, чтобы его чистил CleanupRatingKeys
+func fenceKey(key string) string {
+	return strings.TrimSuffix(key, ":"+lockSuffix) + ":" + fenceSuffix
+}
+
+// doFenced команда cmd над ключом target рейтинга key с проверкой fencing token запуска,
+// без токена в ctx - обычная команда
+func doFenced(ctx context.Context, pool redis.Pool, key RatingKey, cmd, target string, args ...interface{}) (interface{}, error) {
+	token, ok := r.FencingToken(ctx)
+	if !ok {
+		return doContext(ctx, pool, cmd, append([]interface{}{target}, args...)...)
+	}
+	reply, err := doContext(ctx, pool, "EVAL", append([]interface{}{fencedScript, 2, fenceKey(key.LockKey()), target, token, cmd}, args...)...)
+	return reply, staleToken(err)
+}
+
+// staleToken ответ скрипта об устаревшем токене в ErrStaleToken
+func staleToken(err error) error {
+	if e, ok := err.(redis.Error); ok && string(e) == ErrStaleToken.Error() {
+		return ErrStaleToken
+	}
+	return err
+}
+
+type redisLock struct {
+	locker   *RedisLocker
+	key      string
+	token    int64
+	lost     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func (l *redisLock) Token() int64 {
+	return l.token
+}
+
+func (l *redisLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// renew продлеваем блокировку, при ошибках редис пробуем снова до её срока expires.
+// Каждая попытка ограничена этим сроком, поэтому и на зависшем редис блокировка считается
+// потерянной, как только истекла
+func (l *redisLock) renew(period time.Duration, expires time.Time) {
+	defer close(l.stopped)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		attempt := time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), expires)
+		ok, err := redis.Int(doContext(ctx, l.locker.Pool, "EVAL", renewLockScript, 1, l.key, l.token, l.locker.TTL.Milliseconds()))
+		cancel()
+		if err == nil && ok == 1 {
+			expires = attempt.Add(l.locker.TTL)
+			continue
+		}
+		if err == nil || !time.Now().Before(expires) {
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// Unlock продление может висеть до срока блокировки, поэтому ждём его не дольше ctx
+func (l *redisLock) Unlock(ctx context.Context) error {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	select {
+	case <-l.stopped:
+	case <-ctx.Done():
+		return errors.WithMessage(ctx.Err(), "cannot release lock")
+	}
+	_, err := doContext(ctx, l.locker.Pool, "EVAL", releaseLockScript, 1, l.key, l.token)
+	if err != nil {
+		return errors.WithMessage(err, "cannot release lock")
+	}
+	return nil
+}
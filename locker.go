@@ -0,0 +1,120 @@
+package ratiing_filter
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// unlockTimeout блокировку снимаем и после отмены контекста запуска, но не ждём вечно
+const unlockTimeout = 5 * time.Second
+
+var (
+	// ErrLocked рейтинг сейчас обрабатывает другой запуск
+	ErrLocked = errors.New("rating is locked")
+	// ErrLockLost блокировка истекла или перехвачена во время запуска
+	ErrLockLost = errors.New("rating lock lost")
+)
+
+// Locker блокировка запусков по ключу рейтинга
+type Locker interface {
+	// Lock возвращает ErrLocked, если блокировку держит кто-то другой
+	Lock(ctx context.Context, key string) (Lock, error)
+}
+
+// Lock взятая блокировка
+type Lock interface {
+	// Token fencing token, растёт с каждым захватом ключа, хранилище может отвергать записи со старым
+	Token() int64
+	// Lost закрывается, если блокировку не удалось удержать
+	Lost() <-chan struct{}
+	Unlock(ctx context.Context) error
+}
+
+type fencingTokenKey struct{}
+
+// FencingToken токен блокировки текущего запуска, доступен в RatingSaver и ChunkSaver
+func FencingToken(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(fencingTokenKey{}).(int64)
+	return token, ok
+}
+
+// WithFencingToken контекст с токеном блокировки для запусков, которые берут её сами
+func WithFencingToken(ctx context.Context, token int64) context.Context {
+	return context.WithValue(ctx, fencingTokenKey{}, token)
+}
+
+// lockContext контекст запуска под блокировкой, отменяется с причиной ErrLockLost при её потере
+func lockContext(ctx context.Context, lock Lock) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(WithFencingToken(ctx, lock.Token()))
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel(ErrLockLost)
+		case <-stop:
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		cancel(nil)
+	}
+}
+
+// MemoryLocker блокировки в памяти процесса, для тестов и запуска в один инстанс
+type MemoryLocker struct {
+	mu     sync.Mutex
+	locks  map[string]*memoryLock
+	tokens map[string]int64
+}
+
+func (l *MemoryLocker) Lock(_ context.Context, key string) (Lock, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[string]*memoryLock)
+		l.tokens = make(map[string]int64)
+	}
+	if _, ok := l.locks[key]; ok {
+		return nil, ErrLocked
+	}
+	l.tokens[key]++
+	lock := &memoryLock{locker: l, key: key, token: l.tokens[key], lost: make(chan struct{})}
+	l.locks[key] = lock
+	return lock, nil
+}
+
+// expire отбираем блокировку, как будто она истекла
+func (l *MemoryLocker) expire(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lock, ok := l.locks[key]; ok {
+		delete(l.locks, key)
+		close(lock.lost)
+	}
+}
+
+type memoryLock struct {
+	locker *MemoryLocker
+	key    string
+	token  int64
+	lost   chan struct{}
+}
+
+func (l *memoryLock) Token() int64 {
+	return l.token
+}
+
+func (l *memoryLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *memoryLock) Unlock(context.Context) error {
+	l.locker.mu.Lock()
+	defer l.locker.mu.Unlock()
+	if l.locker.locks[l.key] == l {
+		delete(l.locker.locks, l.key)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package ratiing_filter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+type runIDKey struct{}
+
+// WithRunID задаём ID запуска, например из планировщика, иначе GetEvent и GetRewardUsers создают свой
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// RunID ID текущего запуска, доступен в EventsProcessor и остальных callback
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+// NewRunID случайный ID запуска
+func NewRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ensureRunID берём ID запуска из ctx или создаём новый
+func ensureRunID(ctx context.Context) (context.Context, string) {
+	if runID := RunID(ctx); runID != "" {
+		return ctx, runID
+	}
+	runID := NewRunID()
+	return WithRunID(ctx, runID), runID
+}
+
+// runLogger логгер запуска, nil - slog.Default()
+func runLogger(logger *slog.Logger, runID, name string) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("run_id", runID, "rating", name)
+}
@@ -0,0 +1,102 @@
+package ratiing_filter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	approto "proto"
+	"strconv"
+	"time"
+)
+
+// метрики запусков, рейтинг в метках - ScopeEvent.Name и ScopeDislikeReward.Name;
+// запуски DryRun не учитываются
+var (
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rating",
+		Name:      "run_duration_seconds",
+		Help:      "Duration of GetEvent and GetRewardUsers runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"rating", "kind", "result"})
+	ratingSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "rating",
+		Name:      "size",
+		Help:      "Users in the current rating before filtering.",
+	}, []string{"rating"})
+	filteredUsers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "rating",
+		Name:      "filtered_users",
+		Help:      "Users removed from the current rating by RatingFilter.",
+	}, []string{"rating"})
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rating",
+		Name:      "events_total",
+		Help:      "Events created by GetEvent per kind.",
+	}, []string{"rating", "event"})
+	chunkUsers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "rating",
+		Name:      "chunk_users",
+		Help:      "Users in each chunk of the current rating.",
+	}, []string{"rating", "chunk"})
+	rewardFactorTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rating",
+		Name:      "reward_factor_total",
+		Help:      "Sum of reward factors computed by GetRewardUsers per currency.",
+	}, []string{"rating", "currency"})
+)
+
+func runResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// observeRating размер рейтинга и сколько отсеял фильтр
+func observeRating(name string, current, filtered []*approto.RatingItem) {
+	ratingSize.WithLabelValues(name).Set(float64(len(current)))
+	filteredUsers.WithLabelValues(name).Set(float64(len(current) - len(filtered)))
+}
+
+func observeEventRun(name string, started time.Time, current []*approto.RatingItem, chunks int, report *EventReport, err error) {
+	runDuration.WithLabelValues(name, "events", runResult(err)).Observe(time.Since(started).Seconds())
+	if report == nil {
+		return
+	}
+	observeRating(name, current, report.FilteredRating)
+
+	for _, e := range report.Events {
+		eventsTotal.WithLabelValues(name, EventName(e.Event)).Inc()
+	}
+	// опустевшие чанки тоже обновляем, иначе в них останется прошлое значение
+	populations := make(map[int]int, chunks)
+	for chunk := 1; chunk <= chunks; chunk++ {
+		populations[chunk] = 0
+	}
+	for _, chunk := range report.CurrentChunks {
+		populations[chunk]++
+	}
+	for chunk, users := range populations {
+		chunkUsers.WithLabelValues(name, strconv.Itoa(chunk)).Set(float64(users))
+	}
+}
+
+func observeRewardRun(name string, started time.Time, current []*approto.RatingItem, report *RewardReport, err error) {
+	runDuration.WithLabelValues(name, "rewards", runResult(err)).Observe(time.Since(started).Seconds())
+	if report == nil {
+		return
+	}
+	observeRating(name, current, report.FilteredRating)
+
+	var ruby, vip int64
+	for _, rew := range report.Rewards {
+		// счётчик не уменьшается, отрицательные множители словарь не пропускает
+		if rew.FactorRuby > 0 {
+			ruby += rew.FactorRuby
+		}
+		if rew.FactorVIP > 0 {
+			vip += rew.FactorVIP
+		}
+	}
+	rewardFactorTotal.WithLabelValues(name, "ruby").Add(float64(ruby))
+	rewardFactorTotal.WithLabelValues(name, "vip").Add(float64(vip))
+}
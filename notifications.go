@@ -0,0 +1,293 @@
+package ratiing_filter
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// каналы доставки уведомлений
+const (
+	ChannelPush  = "push"
+	ChannelInApp = "in_app"
+)
+
+// TransitionKey событие и переход между чанками, 0 в From или To подходит к любому чанку
+type TransitionKey struct {
+	Event int
+	From  int
+	To    int
+}
+
+// TransitionTemplate шаблон уведомления на text/template для локали и перехода,
+// в шаблоне доступны {{.Rank}}, {{.Chunk}}, {{.PreviousChunk}} и {{.Reward}}
+type TransitionTemplate struct {
+	Locale string
+	TransitionKey
+	Title    string
+	Body     string
+	Channels []string
+}
+
+// NotificationData данные пользователя для шаблона
+type NotificationData struct {
+	Locale string
+	Rank   int
+	Reward string
+}
+
+// Notification готовое уведомление для отправки в push или in-app
+type Notification struct {
+	UserID  uint32
+	Channel string
+	Locale  string
+	Title   string
+	Body    string
+}
+
+type notificationView struct {
+	UserID        uint32
+	Rank          int
+	Chunk         string
+	PreviousChunk string
+	Reward        string
+}
+
+type parsedTemplate struct {
+	title    *template.Template
+	body     *template.Template
+	channels []string
+}
+
+// Notifier превращает события рейтинга в уведомления пользователям
+type Notifier struct {
+	// DefaultLocale локаль, если у пользователя нет своей или для неё нет шаблона
+	DefaultLocale string
+	// ChunkNames названия чанков для шаблонов, например "топ 10", без названия выводится номер
+	ChunkNames map[int]string
+	// UserData данные пользователя для шаблона, nil - только локаль по умолчанию
+	UserData func(ctx context.Context, userID uint32) (NotificationData, error)
+	// Limiter ограничение частоты уведомлений на пользователя, nil - без ограничения
+	Limiter RateLimiter
+	// Send доставка уведомлений
+	Send func(ctx context.Context, n []Notification) error
+
+	templates map[string]map[TransitionKey]*parsedTemplate
+}
+
+// NewNotifier разбирает шаблоны, ошибки в шаблонах видны сразу при запуске
+func NewNotifier(templates []TransitionTemplate) (*Notifier, error) {
+	n := &Notifier{templates: make(map[string]map[TransitionKey]*parsedTemplate)}
+	for _, t := range templates {
+		title, err := template.New("title").Option("missingkey=error").Parse(t.Title)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "cannot parse title of %s %+v", t.Locale, t.TransitionKey)
+		}
+		body, err := template.New("body").Option("missingkey=error").Parse(t.Body)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "cannot parse body of %s %+v", t.Locale, t.TransitionKey)
+		}
+		channels := t.Channels
+		if len(channels) == 0 {
+			channels = []string{ChannelPush}
+		}
+		if n.templates[t.Locale] == nil {
+			n.templates[t.Locale] = make(map[TransitionKey]*parsedTemplate)
+		}
+		n.templates[t.Locale][t.TransitionKey] = &parsedTemplate{title: title, body: body, channels: channels}
+	}
+	return n, nil
+}
+
+// Processor подходит как ScopeEvent.EventsProcessor, лимит расходуется только после успешной отправки
+func (n *Notifier) Processor() func(ctx context.Context, e []Event) error {
+	return func(ctx context.Context, events []Event) error {
+		notifications, notified, err := n.build(ctx, events)
+		if err != nil {
+			return err
+		}
+		if len(notifications) == 0 {
+			return nil
+		}
+		err = n.Send(ctx, notifications)
+		if err != nil {
+			return err
+		}
+		if n.Limiter == nil {
+			return nil
+		}
+		for _, userID := range notified {
+			err = n.Limiter.Record(ctx, userID)
+			if err != nil {
+				return errors.WithMessagef(err, "notifications are sent, cannot record limit of user %d", userID)
+			}
+		}
+		return nil
+	}
+}
+
+// Build собирает уведомления по событиям, пропуская события без шаблона и пользователей сверх лимита;
+// лимит не расходуется, после отправки его учитывают через Limiter.Record
+func (n *Notifier) Build(ctx context.Context, events []Event) ([]Notification, error) {
+	notifications, _, err := n.build(ctx, events)
+	return notifications, err
+}
+
+// build уведомления и пользователи по одному на каждое событие, попавшее в уведомления
+func (n *Notifier) build(ctx context.Context, events []Event) ([]Notification, []uint32, error) {
+	var (
+		notifications []Notification
+		notified      []uint32
+		// planned события пользователя, уже попавшие в эту пачку
+		planned = make(map[uint32]int64)
+	)
+	for _, e := range events {
+		data := NotificationData{Locale: n.DefaultLocale}
+		if n.UserData != nil {
+			var err error
+			data, err = n.UserData(ctx, e.UserID)
+			if err != nil {
+				return nil, nil, errors.WithMessagef(err, "cannot get notification data of user %d", e.UserID)
+			}
+		}
+
+		locale, tmpl := n.lookup(data.Locale, e)
+		if tmpl == nil {
+			continue
+		}
+		if n.Limiter != nil {
+			remaining, err := n.Limiter.Remaining(ctx, e.UserID)
+			if err != nil {
+				return nil, nil, errors.WithMessagef(err, "cannot check notification limit of user %d", e.UserID)
+			}
+			if remaining-planned[e.UserID] <= 0 {
+				continue
+			}
+		}
+
+		view := notificationView{
+			UserID:        e.UserID,
+			Rank:          data.Rank,
+			Chunk:         n.chunkName(e.CurrentChunk),
+			PreviousChunk: n.chunkName(e.PreviousChunk),
+			Reward:        data.Reward,
+		}
+		title, err := execute(tmpl.title, view)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := execute(tmpl.body, view)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, channel := range tmpl.channels {
+			notifications = append(notifications, Notification{
+				UserID:  e.UserID,
+				Channel: channel,
+				Locale:  locale,
+				Title:   title,
+				Body:    body,
+			})
+		}
+		planned[e.UserID]++
+		notified = append(notified, e.UserID)
+	}
+	return notifications, notified, nil
+}
+
+// lookup ищет шаблон от точного перехода к общему, сначала в локали пользователя, затем в локали по умолчанию
+func (n *Notifier) lookup(locale string, e Event) (string, *parsedTemplate) {
+	keys := []TransitionKey{
+		{Event: e.Event, From: e.PreviousChunk, To: e.CurrentChunk},
+		{Event: e.Event, To: e.CurrentChunk},
+		{Event: e.Event, From: e.PreviousChunk},
+		{Event: e.Event},
+	}
+	for _, l := range []string{locale, n.DefaultLocale} {
+		for _, key := range keys {
+			if tmpl, ok := n.templates[l][key]; ok {
+				return l, tmpl
+			}
+		}
+	}
+	return "", nil
+}
+
+func (n *Notifier) chunkName(chunk int) string {
+	if name, ok := n.ChunkNames[chunk]; ok {
+		return name
+	}
+	return strconv.Itoa(chunk)
+}
+
+func execute(tmpl *template.Template, view notificationView) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, view)
+	if err != nil {
+		return "", errors.WithMessagef(err, "cannot execute %s template", tmpl.Name())
+	}
+	return buf.String(), nil
+}
+
+// RateLimiter ограничение частоты уведомлений на пользователя; между Remaining и Record
+// другой инстанс может успеть отправить своё, лимит может быть превышен на число инстансов
+type RateLimiter interface {
+	// Remaining сколько ещё уведомлений можно отправить пользователю, бюджет не расходуется
+	Remaining(ctx context.Context, userID uint32) (int64, error)
+	// Record учитываем отправленное пользователю уведомление
+	Record(ctx context.Context, userID uint32) error
+}
+
+// MemoryRateLimiter не больше Limit уведомлений пользователю за Window в памяти процесса
+type MemoryRateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu    sync.Mutex
+	sent  map[uint32][]time.Time
+	clock func() time.Time
+}
+
+func (l *MemoryRateLimiter) Remaining(_ context.Context, userID uint32) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	remaining := l.Limit - len(l.recent(userID, l.now()))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return int64(remaining), nil
+}
+
+func (l *MemoryRateLimiter) Record(_ context.Context, userID uint32) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sent[userID] = append(l.recent(userID, now), now)
+	return nil
+}
+
+// recent оставляем только отправки внутри окна, вызывается под mu
+func (l *MemoryRateLimiter) recent(userID uint32, now time.Time) []time.Time {
+	if l.sent == nil {
+		l.sent = make(map[uint32][]time.Time)
+	}
+	recent := l.sent[userID][:0]
+	for _, t := range l.sent[userID] {
+		if now.Sub(t) < l.Window {
+			recent = append(recent, t)
+		}
+	}
+	l.sent[userID] = recent
+	return recent
+}
+
+func (l *MemoryRateLimiter) now() time.Time {
+	if l.clock != nil {
+		return l.clock()
+	}
+	return time.Now()
+}
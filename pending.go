@@ -0,0 +1,58 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	r "ratings_filters/rating_filter"
+)
+
+// GetPendingChanges читаем неподтверждённые переходы рейтинга key
+func GetPendingChanges(ctx context.Context, pool redis.Pool, key RatingKey) (map[uint32]r.PendingChange, error) {
+	err := key.Validate()
+	if err != nil {
+		return nil, err
+	}
+	b, err := redis.Bytes(doContext(ctx, pool, "GET", key.PendingKey()))
+	if err == redis.ErrNil {
+		return nil, r.ErrNotFound
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "cannot fetch pending changes")
+	}
+	var pending map[uint32]r.PendingChange
+	err = json.Unmarshal(b, &pending)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot unmarshal pending changes")
+	}
+	return pending, nil
+}
+
+// SavePendingChanges перезаписываем неподтверждённые переходы целиком, пустое состояние удаляет ключ,
+// из opts используется только TTL
+func SavePendingChanges(ctx context.Context, pool redis.Pool, key RatingKey, pending map[uint32]r.PendingChange, opts SnapshotOptions) error {
+	err := key.Validate()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		_, err = doFenced(ctx, pool, key, "DEL", key.PendingKey())
+		if err != nil {
+			return errors.WithMessage(err, "cannot delete pending changes")
+		}
+		return nil
+	}
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return errors.WithMessage(err, "cannot marshal pending changes")
+	}
+	args := redis.Args{}.Add(b)
+	if opts.TTL > 0 {
+		args = args.Add("PX", opts.TTL.Milliseconds())
+	}
+	_, err = doFenced(ctx, pool, key, "SET", key.PendingKey(), args...)
+	if err != nil {
+		return errors.WithMessage(err, "cannot save pending changes")
+	}
+	return nil
+}
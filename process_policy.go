@@ -0,0 +1,54 @@
+package ratiing_filter
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/pkg/errors"
+)
+
+// ErrDeadLettered события не обработаны, но отложены в DeadLetter и снапшот сохранён,
+// проверяется через errors.Is
+var ErrDeadLettered = errors.New("events are dead lettered")
+
+// ProcessFailurePolicy что делать со снапшотом, если EventsProcessor вернул ошибку
+type ProcessFailurePolicy int
+
+const (
+	// AbortOnProcessError не сохраняем снапшот, события повторятся в следующий запуск
+	AbortOnProcessError ProcessFailurePolicy = iota
+	// SaveOnProcessError сохраняем снапшот и возвращаем ошибку обработки вместе с ошибкой сохранения
+	SaveOnProcessError
+	// DeadLetterOnProcessError отдаём события в DeadLetter, сохраняем снапшот и возвращаем ErrDeadLettered
+	// вместе с ошибкой обработки, если DeadLetter не справился - не сохраняем, чтобы события не потерялись;
+	// при обработке пачками это единственная политика без повторной отправки успешных пачек
+	DeadLetterOnProcessError
+)
+
+// handleEvents обрабатываем события и по политике решаем, сохранять ли снапшот
+func (s ScopeEvent) handleEvents(ctx context.Context, events []Event) (save bool, err error) {
+	err = s.processEvents(ctx, events)
+	if err == nil {
+		return true, nil
+	}
+	// откладываем только события из необработанных пачек
+	failed := events
+	if batchErr, ok := err.(*BatchError); ok {
+		failed = batchErr.FailedEvents()
+	}
+	err = errors.WithMessage(err, "cannot process events")
+
+	switch s.OnProcessError {
+	case SaveOnProcessError:
+		return true, err
+	case DeadLetterOnProcessError:
+		if s.DeadLetter == nil {
+			return false, errors.WithMessage(err, "dead letter is not configured")
+		}
+		dlErr := s.DeadLetter(ctx, failed, err)
+		if dlErr != nil {
+			return false, errors.WithMessagef(err, "cannot dead letter events: %v", dlErr)
+		}
+		return true, stderrors.Join(ErrDeadLettered, err)
+	}
+	return false, err
+}
@@ -0,0 +1,49 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// recordNotificationScript срок ставится вместе с созданием счётчика, иначе счётчик,
+// истёкший между командами, пересоздался бы без срока
+const recordNotificationScript = `local sent = redis.call("INCR", KEYS[1])
+if sent == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return sent`
+
+// RedisRateLimiter не больше Limit уведомлений пользователю за окно Window, общий для всех инстансов,
+// окно фиксированное и начинается с первого уведомления
+type RedisRateLimiter struct {
+	Pool   redis.Pool
+	Prefix string
+	Limit  int64
+	Window time.Duration
+}
+
+func (l *RedisRateLimiter) Remaining(ctx context.Context, userID uint32) (int64, error) {
+	sent, err := redis.Int64(doContext(ctx, l.Pool, "GET", l.key(userID)))
+	if err == redis.ErrNil {
+		return l.Limit, nil
+	} else if err != nil {
+		return 0, errors.WithMessage(err, "cannot get notification counter")
+	}
+	if sent >= l.Limit {
+		return 0, nil
+	}
+	return l.Limit - sent, nil
+}
+
+func (l *RedisRateLimiter) Record(ctx context.Context, userID uint32) error {
+	_, err := doContext(ctx, l.Pool, "EVAL", recordNotificationScript, 1, l.key(userID), l.Window.Milliseconds())
+	if err != nil {
+		return errors.WithMessage(err, "cannot increment notification counter")
+	}
+	return nil
+}
+
+func (l *RedisRateLimiter) key(userID uint32) string {
+	return fmt.Sprintf("%s:%d", l.Prefix, userID)
+}
@@ -0,0 +1,195 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// keyPrefix общий префикс всех ключей рейтингов
+const keyPrefix = "rating"
+
+// deadLetterPrefix префикс необработанных событий, отдельный от keyPrefix,
+// чтобы CleanupRatingKeys не удалял их вместе со старыми снапшотами до replay
+const deadLetterPrefix = "ratingdeadletter"
+
+// суффиксы ключей, хранящихся рядом со снапшотом
+const (
+	chunksSuffix  = "chunks"
+	pendingSuffix = "pending"
+	lockSuffix    = "lock"
+	fenceSuffix   = "fence"
+)
+
+// scanCount подсказка редису, сколько ключей отдавать за один SCAN
+const scanCount = 1000
+
+// RatingKey ключ снапшота рейтинга вида rating:{env}:{name}:{period}
+type RatingKey struct {
+	// Env окружение, например prod или develop, чтобы окружения не перетирали друг друга
+	Env  string
+	Name string
+	// Period период рейтинга, форматы должны сортироваться как строки, см. DailyPeriod
+	Period string
+}
+
+func (k RatingKey) String() string {
+	return strings.Join([]string{keyPrefix, k.Env, k.Name, k.Period}, ":")
+}
+
+// ChunksKey ключ карты чанков этого рейтинга
+func (k RatingKey) ChunksKey() string {
+	return k.String() + ":" + chunksSuffix
+}
+
+// DeadLetterKey ключ списка необработанных событий этого рейтинга, вне шаблонов RatingKeyPattern
+func (k RatingKey) DeadLetterKey() string {
+	return strings.Join([]string{deadLetterPrefix, k.Env, k.Name, k.Period}, ":")
+}
+
+// PendingKey ключ неподтверждённых переходов гистерезиса этого рейтинга
+func (k RatingKey) PendingKey() string {
+	return k.String() + ":" + pendingSuffix
+}
+
+// LockKey ключ блокировки запусков по этому рейтингу
+func (k RatingKey) LockKey() string {
+	return k.String() + ":" + lockSuffix
+}
+
+// Validate части ключа не могут быть пустыми и содержать разделитель или символы шаблона
+func (k RatingKey) Validate() error {
+	for _, part := range []string{k.Env, k.Name, k.Period} {
+		if part == "" || strings.ContainsAny(part, ":*?[]") {
+			return errors.Errorf("invalid rating key %q", k.String())
+		}
+	}
+	return nil
+}
+
+// ParseRatingKey разбирает ключ снапшота или ключ рядом с ним
+func ParseRatingKey(key string) (RatingKey, error) {
+	parts := strings.Split(key, ":")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != keyPrefix {
+		return RatingKey{}, errors.Errorf("not a rating key %q", key)
+	}
+	k := RatingKey{Env: parts[1], Name: parts[2], Period: parts[3]}
+	return k, k.Validate()
+}
+
+// RatingKeyPattern шаблон SCAN по окружению и имени рейтинга, пустые части означают любые
+func RatingKeyPattern(env, name string) string {
+	if env == "" {
+		env = "*"
+	}
+	if name == "" {
+		name = "*"
+	}
+	return fmt.Sprintf("%s:%s:%s:*", keyPrefix, env, name)
+}
+
+// DailyPeriod период суточного рейтинга
+func DailyPeriod(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// WeeklyPeriod период недельного рейтинга по ISO неделям
+func WeeklyPeriod(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%04dW%02d", year, week)
+}
+
+// periodStart начало периода DailyPeriod или WeeklyPeriod и его формат
+func periodStart(period string) (time.Time, string, error) {
+	if t, err := time.Parse("20060102", period); err == nil && DailyPeriod(t) == period {
+		return t, "daily", nil
+	}
+	var year, week int
+	if _, err := fmt.Sscanf(period, "%4dW%2d", &year, &week); err == nil && len(period) == 7 {
+		// понедельник недели, в которую попадает 4 января, - начало первой ISO недели
+		jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+		sinceMonday := (int(jan4.Weekday()) + 6) % 7
+		t := jan4.AddDate(0, 0, (week-1)*7-sinceMonday)
+		if WeeklyPeriod(t) == period {
+			return t, "weekly", nil
+		}
+	}
+	return time.Time{}, "", errors.Errorf("unknown period format %q", period)
+}
+
+// ListRatingKeys перечисляем ключи рейтингов по шаблону через SCAN, не блокируя редис
+func ListRatingKeys(ctx context.Context, pool redis.Pool, pattern string) ([]string, error) {
+	var (
+		keys   []string
+		cursor int64
+	)
+	for {
+		values, err := redis.Values(doContext(ctx, pool, "SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot scan rating keys")
+		}
+		if len(values) != 2 {
+			return nil, errors.Errorf("unexpected scan reply of %d values", len(values))
+		}
+		cursor, err = redis.Int64(values[0], nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse scan cursor")
+		}
+		page, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse scan keys")
+		}
+		keys = append(keys, page...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// CleanupRatingKeys удаляем ключи рейтингов по шаблону, период которых начался раньше before,
+// при dryRun только возвращаем, что было бы удалено. Периоды сравниваются как даты и только
+// в формате before: суточный before не трогает недельные ключи и наоборот
+func CleanupRatingKeys(ctx context.Context, pool redis.Pool, pattern, before string, dryRun bool) ([]string, error) {
+	beforeStart, format, err := periodStart(before)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid before")
+	}
+	keys, err := ListRatingKeys(ctx, pool, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for _, key := range keys {
+		k, err := ParseRatingKey(key)
+		if err != nil {
+			// чужие ключи под шаблоном не трогаем
+			continue
+		}
+		start, keyFormat, err := periodStart(k.Period)
+		if err != nil || keyFormat != format {
+			continue
+		}
+		if start.Before(beforeStart) {
+			stale = append(stale, key)
+		}
+	}
+	if dryRun || len(stale) == 0 {
+		return stale, nil
+	}
+
+	for start := 0; start < len(stale); start += scanCount {
+		end := start + scanCount
+		if end > len(stale) {
+			end = len(stale)
+		}
+		_, err = doContext(ctx, pool, "DEL", redis.Args{}.AddFlat(stale[start:end])...)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot delete stale rating keys")
+		}
+	}
+	return stale, nil
+}
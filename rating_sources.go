@@ -0,0 +1,264 @@
+package helpers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io/ioutil"
+	"mysql"
+	"net/http"
+	approto "proto-compile"
+	"ratings_filters/interfaces"
+	"time"
+)
+
+// типы источников рейтинга в RatingSourceConfig.Type
+const (
+	SourceMongo   = "mongo"
+	SourceEvents  = "events"
+	SourceMySQL   = "mysql"
+	SourceService = "service"
+	SourceFile    = "file"
+)
+
+// DislikesRatingSource рейтинг по дизлайкам за день из GetDislikesByEndOfDate, больше дизлайков - выше место
+type DislikesRatingSource struct {
+	Pool *mysql.ConnectionsPool
+	// Date день в формате колонки date таблицы Talk.user_like, в jobs задаётся JobConfig.DislikesDate
+	Date int64
+}
+
+func (s *DislikesRatingSource) GetRating(ctx context.Context) ([]*approto.RatingItem, error) {
+	dislikes, err := GetDislikesByEndOfDate(ctx, s.Pool, s.Date)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot get dislikes")
+	}
+	users := make([]*RatingsUser, 0, len(dislikes))
+	for userID, count := range dislikes {
+		users = append(users, &RatingsUser{UserID: int64(userID), Count: count})
+	}
+	return RatingConverter(getRankedUser(users))
+}
+
+// MongoRatingSource рейтинг из коллекции с уже посчитанными очками
+type MongoRatingSource struct {
+	Collection *mongo.Collection
+	Schema     RatingSchema
+	Options    ReadOptions
+}
+
+func (s *MongoRatingSource) GetRating(ctx context.Context) ([]*approto.RatingItem, error) {
+	rating, _, err := GetRatings(ctx, s.Collection, s.Schema, s.Options)
+	if err != nil {
+		return nil, err
+	}
+	return RatingConverter(rating)
+}
+
+// EventsRatingSource рейтинг, собираемый из сырых событий за окно
+type EventsRatingSource struct {
+	Collection *mongo.Collection
+	Schema     EventsSchema
+	// Window окно рейтинга относительно момента запуска
+	Window  func(now time.Time) Window
+	Options ReadOptions
+}
+
+func (s *EventsRatingSource) GetRating(ctx context.Context) ([]*approto.RatingItem, error) {
+	rating, _, err := AggregateRatings(ctx, s.Collection, s.Schema, s.Window(time.Now()), s.Options)
+	if err != nil {
+		return nil, err
+	}
+	return RatingConverter(rating)
+}
+
+// MySQLRatingSource рейтинг из запроса, который возвращает UserID и Value уже в порядке мест
+type MySQLRatingSource struct {
+	Pool  *mysql.ConnectionsPool
+	Query string
+	Args  []interface{}
+}
+
+func (s *MySQLRatingSource) GetRating(ctx context.Context) ([]*approto.RatingItem, error) {
+	// пул mysql контекст не принимает, проверяем хотя бы перед запросом
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var rating []*approto.RatingItem
+	started := time.Now()
+	err := s.Pool.Select(s.Query,
+		func(rows *sql.Rows) error {
+			var (
+				userID uint32
+				value  int64
+			)
+			err := rows.Scan(&userID, &value)
+			if err != nil {
+				return err
+			}
+			rating = append(rating, &approto.RatingItem{
+				Rank:   proto.Uint32(uint32(len(rating) + 1)),
+				UserID: proto.Uint32(userID),
+				Value:  proto.Int64(value),
+			})
+			return nil
+		}, s.Args...)
+	observeStorage(storeMySQL, "select_rating", started, &err)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot select rating")
+	}
+	return rating, nil
+}
+
+// ServiceRatingSource рейтинг из внешнего сервиса, ответ - JSON массив RatingItem
+type ServiceRatingSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *ServiceRatingSource) GetRating(ctx context.Context) ([]*approto.RatingItem, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot create rating request")
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot request rating")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("rating service responded %s", resp.Status)
+	}
+
+	var rating []*approto.RatingItem
+	err = json.NewDecoder(resp.Body).Decode(&rating)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot unmarshal rating")
+	}
+	return rating, nil
+}
+
+// FileRatingSource рейтинг из JSON файла в формате снапшота
+type FileRatingSource struct {
+	Path string
+}
+
+func (s *FileRatingSource) GetRating(_ context.Context) ([]*approto.RatingItem, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot read rating file")
+	}
+	var rating []*approto.RatingItem
+	err = json.Unmarshal(b, &rating)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot unmarshal rating")
+	}
+	return rating, nil
+}
+
+// RatingSourceConfig описание источника рейтинга в конфиге, используются только поля его типа
+type RatingSourceConfig struct {
+	Type string
+	// mongo и events
+	Collection string
+	Schema     RatingSchema
+	Events     EventsSchema
+	Window     WindowConfig
+	Options    ReadOptions
+	// mysql
+	Query string
+	Args  []interface{}
+	// service
+	URL string
+	// file
+	Path string
+}
+
+// WindowConfig окно рейтинга из сырых событий: daily, weekly, rolling или season
+type WindowConfig struct {
+	Type string
+	// Rolling длина скользящего окна, например "168h"
+	Rolling string
+	From    time.Time
+	To      time.Time
+}
+
+// SourceDeps подключения, из которых собираются источники
+type SourceDeps struct {
+	Mongo *mongo.Database
+	SQL   *mysql.ConnectionsPool
+	HTTP  *http.Client
+}
+
+// NewRatingSource собирает источник рейтинга по конфигу
+func NewRatingSource(cfg RatingSourceConfig, deps SourceDeps) (interfaces.RatingSource, error) {
+	switch cfg.Type {
+	case SourceMongo:
+		if deps.Mongo == nil {
+			return nil, errors.New("mongo source requires mongo database")
+		}
+		schema := cfg.Schema
+		if schema.UserField == "" {
+			schema = DefaultRatingSchema
+		}
+		return &MongoRatingSource{
+			Collection: deps.Mongo.Collection(cfg.Collection),
+			Schema:     schema,
+			Options:    cfg.Options,
+		}, nil
+	case SourceEvents:
+		if deps.Mongo == nil {
+			return nil, errors.New("events source requires mongo database")
+		}
+		window, err := cfg.Window.build()
+		if err != nil {
+			return nil, err
+		}
+		return &EventsRatingSource{
+			Collection: deps.Mongo.Collection(cfg.Collection),
+			Schema:     cfg.Events,
+			Window:     window,
+			Options:    cfg.Options,
+		}, nil
+	case SourceMySQL:
+		if deps.SQL == nil {
+			return nil, errors.New("mysql source requires sql pool")
+		}
+		return &MySQLRatingSource{Pool: deps.SQL, Query: cfg.Query, Args: cfg.Args}, nil
+	case SourceService:
+		return &ServiceRatingSource{URL: cfg.URL, Client: deps.HTTP}, nil
+	case SourceFile:
+		return &FileRatingSource{Path: cfg.Path}, nil
+	}
+	return nil, errors.Errorf("unknown rating source %q", cfg.Type)
+}
+
+func (c WindowConfig) build() (func(now time.Time) Window, error) {
+	switch c.Type {
+	case "daily":
+		return DailyWindow, nil
+	case "weekly":
+		return WeeklyWindow, nil
+	case "rolling":
+		d, err := time.ParseDuration(c.Rolling)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse rolling window")
+		}
+		return func(now time.Time) Window {
+			return RollingWindow(now, d)
+		}, nil
+	case "season":
+		season := SeasonWindow(c.From, c.To)
+		return func(time.Time) Window {
+			return season
+		}, nil
+	}
+	return nil, errors.Errorf("unknown window %q", c.Type)
+}
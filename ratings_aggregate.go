@@ -0,0 +1,125 @@
+package helpers
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Window период рейтинга [From, To)
+type Window struct {
+	From time.Time
+	To   time.Time
+}
+
+// DailyWindow сутки, в которые попадает t, в часовом поясе t
+func DailyWindow(t time.Time) Window {
+	from := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return Window{From: from, To: from.AddDate(0, 0, 1)}
+}
+
+// WeeklyWindow неделя с понедельника, в которую попадает t
+func WeeklyWindow(t time.Time) Window {
+	day := DailyWindow(t).From
+	offset := (int(day.Weekday()) + 6) % 7
+	from := day.AddDate(0, 0, -offset)
+	return Window{From: from, To: from.AddDate(0, 0, 7)}
+}
+
+// RollingWindow скользящее окно длиной d, заканчивающееся в t, например 7 последних дней
+func RollingWindow(t time.Time, d time.Duration) Window {
+	return Window{From: t.Add(-d), To: t}
+}
+
+// SeasonWindow произвольный сезон
+func SeasonWindow(from, to time.Time) Window {
+	return Window{From: from, To: to}
+}
+
+// EventsSchema описывает коллекцию сырых событий (лайки, платежи)
+type EventsSchema struct {
+	UserField string
+	// TimeField поле времени события, должно храниться как Date
+	TimeField string
+	// ValueField суммируемое поле, например сумма платежа, пусто - считаем число событий
+	ValueField string
+	// Filter дополнительные условия на события, например тип события
+	Filter bson.M
+}
+
+// AggregateRatings строит рейтинг из сырых событий за окно window агрегацией на стороне монги,
+// при равенстве очков выше тот, кто набрал их раньше
+func AggregateRatings(ctx context.Context, collection *mongo.Collection, schema EventsSchema, window Window, opts ReadOptions) (rating []*RankedUser, skipped int, err error) {
+	defer observeStorage(storeMongo, "aggregate_ratings", time.Now(), &err)
+	var ratings []*RatingsUser
+
+	cur, err := collection.Aggregate(ctx, schema.pipeline(window), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, 0, errors.WithMessage(err, "cannot aggregate ratings")
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), cursorCloseTimeout)
+		defer cancel()
+		closeErr := cur.Close(closeCtx)
+		if closeErr != nil && err == nil {
+			rating, err = nil, errors.WithMessage(closeErr, "cannot close aggregation cursor")
+		}
+	}()
+
+	for cur.Next(ctx) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, skipped, errors.WithMessage(ctxErr, "ratings aggregation interrupted")
+		}
+
+		elem, decodeErr := aggregatedSchema.decode(cur.Current)
+		if decodeErr != nil {
+			if opts.SkipBadDocuments {
+				skipped++
+				continue
+			}
+			return nil, skipped, errors.WithMessagef(decodeErr, "cannot decode aggregated rating %s", cur.Current)
+		}
+
+		ratings = append(ratings, elem)
+	}
+
+	if curErr := cur.Err(); curErr != nil {
+		return nil, skipped, errors.WithMessage(curErr, "cannot iterate aggregated ratings")
+	}
+
+	return getRankedUser(ratings), skipped, nil
+}
+
+// aggregatedSchema схема документов на выходе pipeline
+var aggregatedSchema = RatingSchema{
+	UserField:     "_id",
+	ScoreField:    "score",
+	TieBreakField: "reached",
+}
+
+func (s EventsSchema) pipeline(window Window) mongo.Pipeline {
+	match := bson.M{
+		s.TimeField: bson.M{"$gte": window.From, "$lt": window.To},
+	}
+	for k, v := range s.Filter {
+		match[k] = v
+	}
+
+	var score interface{} = 1
+	if s.ValueField != "" {
+		score = "$" + s.ValueField
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$" + s.UserField},
+			{Key: "score", Value: bson.D{{Key: "$sum", Value: score}}},
+			{Key: "reached", Value: bson.D{{Key: "$max", Value: "$" + s.TimeField}}},
+		}}},
+		{{Key: "$sort", Value: aggregatedSchema.sort()}},
+	}
+}
@@ -0,0 +1,97 @@
+package helpers
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"strings"
+)
+
+// RatingSchema описывает, в каких полях коллекции лежит рейтинг, поля можно указывать через точку
+type RatingSchema struct {
+	UserField  string
+	ScoreField string
+	// TieBreakField необязательное поле времени, при равных очках выше тот, у кого оно меньше
+	TieBreakField string
+	// Filter запрос к коллекции, nil - все документы
+	Filter interface{}
+	// Projection проекция документов, nil - только поля схемы
+	Projection interface{}
+}
+
+// DefaultRatingSchema схема исторических коллекций рейтинга
+var DefaultRatingSchema = RatingSchema{
+	UserField:  "UserID",
+	ScoreField: "100",
+}
+
+func (s RatingSchema) filter() interface{} {
+	if s.Filter == nil {
+		return bson.D{}
+	}
+	return s.Filter
+}
+
+func (s RatingSchema) projection() interface{} {
+	if s.Projection != nil {
+		return s.Projection
+	}
+	p := bson.D{{Key: s.UserField, Value: 1}, {Key: s.ScoreField, Value: 1}}
+	if s.TieBreakField != "" {
+		p = append(p, bson.E{Key: s.TieBreakField, Value: 1})
+	}
+	return p
+}
+
+// sort порядок мест в рейтинге, совпадает с RankedUsers.Less
+func (s RatingSchema) sort() bson.D {
+	d := bson.D{{Key: s.ScoreField, Value: -1}}
+	if s.TieBreakField != "" {
+		d = append(d, bson.E{Key: s.TieBreakField, Value: 1})
+	}
+	return append(d, bson.E{Key: s.UserField, Value: 1})
+}
+
+// decode достаёт пользователя и его очки из документа по схеме
+func (s RatingSchema) decode(raw bson.Raw) (*RatingsUser, error) {
+	var (
+		user RatingsUser
+		err  error
+	)
+	user.UserID, err = lookupInt64(raw, s.UserField)
+	if err != nil {
+		return nil, err
+	}
+	user.Count, err = lookupInt64(raw, s.ScoreField)
+	if err != nil {
+		return nil, err
+	}
+	if s.TieBreakField != "" {
+		user.TieBreak, err = lookupInt64(raw, s.TieBreakField)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func lookupInt64(raw bson.Raw, field string) (int64, error) {
+	v, err := raw.LookupErr(strings.Split(field, ".")...)
+	if err != nil {
+		return 0, errors.WithMessagef(err, "cannot lookup field %q", field)
+	}
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), nil
+	case bsontype.Int64:
+		return v.Int64(), nil
+	case bsontype.Double:
+		return int64(v.Double()), nil
+	case bsontype.DateTime:
+		return v.DateTime(), nil
+	case bsontype.Timestamp:
+		t, _ := v.Timestamp()
+		return int64(t), nil
+	}
+	return 0, errors.Errorf("field %q has unsupported type %s", field, v.Type)
+}
@@ -0,0 +1,117 @@
+package helpers
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// StreamOptions параметры потокового чтения рейтинга
+type StreamOptions struct {
+	// Limit сколько первых мест читать, 0 - весь рейтинг
+	Limit int64
+	// BatchSize размер страницы курсора, 0 - по умолчанию драйвера
+	BatchSize int32
+	// Hint индекс под сортировку рейтинга, например bson.D{{"100", -1}, {"UserID", 1}} для DefaultRatingSchema
+	Hint interface{}
+	// SkipBadDocuments пропускать документы, которые не разбираются по схеме, вместо ошибки
+	SkipBadDocuments bool
+}
+
+// RatingStream итератор по рейтингу, отсортированному на стороне монги,
+// в памяти держит только текущую страницу курсора
+type RatingStream struct {
+	cur     *mongo.Cursor
+	schema  RatingSchema
+	opts    StreamOptions
+	rank    int64
+	skipped int
+	item    *RankedUser
+	err     error
+}
+
+// StreamRatings отдаёт рейтинг по одному пользователю, сортировка и лимит выполняются в монге
+// в том же порядке, что и в GetRatings
+func StreamRatings(ctx context.Context, collection *mongo.Collection, schema RatingSchema, opts StreamOptions) (*RatingStream, error) {
+	findOpts := options.Find().
+		SetSort(schema.sort()).
+		SetProjection(schema.projection())
+	if opts.Limit > 0 {
+		findOpts.SetLimit(opts.Limit)
+	}
+	if opts.BatchSize > 0 {
+		findOpts.SetBatchSize(opts.BatchSize)
+	}
+	if opts.Hint != nil {
+		findOpts.SetHint(opts.Hint)
+	}
+
+	started := time.Now()
+	cur, err := collection.Find(ctx, schema.filter(), findOpts)
+	observeStorage(storeMongo, "stream_ratings", started, &err)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot find ratings")
+	}
+	return &RatingStream{cur: cur, schema: schema, opts: opts}, nil
+}
+
+// Next переходит к следующему месту, возвращает false по окончании рейтинга, при ошибке или отмене ctx
+func (s *RatingStream) Next(ctx context.Context) bool {
+	for s.err == nil {
+		if !s.cur.Next(ctx) {
+			if err := s.cur.Err(); err != nil {
+				s.err = errors.WithMessage(err, "cannot iterate ratings")
+			}
+			return false
+		}
+		if err := ctx.Err(); err != nil {
+			s.err = errors.WithMessage(err, "ratings reading interrupted")
+			return false
+		}
+
+		elem, err := s.schema.decode(s.cur.Current)
+		if err != nil {
+			if s.opts.SkipBadDocuments {
+				s.skipped++
+				continue
+			}
+			s.err = errors.WithMessage(err, "cannot decode rating")
+			return false
+		}
+
+		s.rank++
+		s.item = &RankedUser{
+			Rank:   s.rank,
+			UserID: elem.UserID,
+			Value:  elem.Count,
+		}
+		return true
+	}
+	return false
+}
+
+// Item текущий пользователь с его местом
+func (s *RatingStream) Item() *RankedUser {
+	return s.item
+}
+
+// Skipped число пропущенных документов при SkipBadDocuments
+func (s *RatingStream) Skipped() int {
+	return s.skipped
+}
+
+// Err ошибка, прервавшая итерацию
+func (s *RatingStream) Err() error {
+	return s.err
+}
+
+// Close закрывает курсор, вызывать обязательно
+func (s *RatingStream) Close(ctx context.Context) error {
+	err := s.cur.Close(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "cannot close ratings cursor")
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package helpers
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// doContext выполняет команду редис с учётом ctx. Пул контекст не принимает, поэтому отмена
+// проверяется перед командой, а дедлайн ctx становится таймаутом чтения и записи команды
+// на соединении из пула. Ошибка по дедлайну возвращается как ошибка ctx
+func doContext(ctx context.Context, pool redis.Pool, cmd string, args ...interface{}) (value interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer observeStorage(storeRedis, cmd, time.Now(), &err)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return pool.Do(0, cmd, args...)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	value, err = redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return value, err
+}
@@ -0,0 +1,25 @@
+package ratiing_filter
+
+import (
+	approto "proto"
+)
+
+// EventReport что насчитал GetEvent, заполняется до стадии, на которой случилась ошибка;
+// при DryRun снапшот не сохранён и события никуда не отправлены
+type EventReport struct {
+	DryRun         bool
+	FilteredRating []*approto.RatingItem
+	CurrentChunks  map[uint32]int
+	// PreviousChunks nil, если снапшота ещё не было и событий нет
+	PreviousChunks map[uint32]int
+	Events         []Event
+	// Pending неподтверждённые переходы, только при Hysteresis
+	Pending map[uint32]PendingChange
+}
+
+// RewardReport что насчитал GetRewardUsers, при DryRun награды не выплачены
+type RewardReport struct {
+	DryRun         bool
+	FilteredRating []*approto.RatingItem
+	Rewards        []*RewardUser
+}
@@ -0,0 +1,191 @@
+package ratiing_filter
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// StagePolicy повторы и предохранитель одной стадии, nil - не используются
+type StagePolicy struct {
+	Retry   *RetryPolicy
+	Breaker *CircuitBreaker
+}
+
+// StagePolicies политики стадий GetEvent
+type StagePolicies struct {
+	Fetch StagePolicy
+	// Process повторяется, только если задан RetryPolicy.Retryable: повтор заново отправляет
+	// события получателям, которые их уже приняли. Retry без Retryable отвергается GetEvent
+	Process StagePolicy
+	Save    StagePolicy
+}
+
+// RetryPolicy повтор с экспоненциальной задержкой и джиттером
+type RetryPolicy struct {
+	// MaxAttempts всего попыток, включая первую
+	MaxAttempts int
+	BaseDelay   time.Duration
+	// MaxDelay потолок задержки, 0 - без потолка
+	MaxDelay time.Duration
+	// Jitter доля случайного разброса задержки от 0 до 1
+	Jitter float64
+	// Retryable какие ошибки повторять, nil - IsRetryable
+	Retryable func(err error) bool
+}
+
+// IsRetryable не повторяем отсутствие данных, отмену, таймаут и открытый предохранитель:
+// после таймаута неизвестно, успела ли попытка что-то записать
+func IsRetryable(err error) bool {
+	switch errors.Cause(err) {
+	case nil, ErrNotFound, ErrCircuitOpen, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
+
+// validate повтор обработки событий должен быть подтверждён явным Retryable
+func (p StagePolicies) validate() error {
+	if p.Process.Retry != nil && p.Process.Retry.Retryable == nil {
+		return errors.New("process retry requires explicit Retryable")
+	}
+	return nil
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay == 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// RetryError ошибка стадии с числом сделанных попыток
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v (attempts: %d)", e.Err, e.Attempts)
+}
+
+// Cause для errors.Cause
+func (e *RetryError) Cause() error {
+	return e.Err
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// CircuitBreaker размыкается после Threshold неудач подряд и через Cooldown пропускает один пробный вызов,
+// создаётся один раз и переиспользуется между запусками
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	// IsFailure какие ошибки считать неудачей, nil - IsRetryable и таймауты
+	IsFailure func(err error) bool
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Threshold <= 0 || b.failures < b.Threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.Cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record отмена запуска ничего не говорит о хранилище: счётчик не меняем,
+// а отменённый пробный вызов не замыкает предохранитель, следующий вызов снова пробный
+func (b *CircuitBreaker) record(err error) {
+	failure := IsRetryable(err) || errors.Cause(err) == context.DeadlineExceeded
+	if b.IsFailure != nil {
+		failure = b.IsFailure(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Cause(err) == context.Canceled {
+		return
+	}
+	if !failure {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.Threshold > 0 && b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// runPolicy выполняет стадию с предохранителем и повторами
+func runPolicy[T any](ctx context.Context, timeout time.Duration, policy StagePolicy, stage func(ctx context.Context) (T, error)) (T, error) {
+	if policy.Retry == nil && policy.Breaker == nil {
+		return runStage(ctx, timeout, stage)
+	}
+
+	var (
+		result   T
+		err      error
+		attempts int
+	)
+	for {
+		attempts++
+		if policy.Breaker != nil && !policy.Breaker.allow() {
+			err = ErrCircuitOpen
+		} else {
+			result, err = runStage(ctx, timeout, stage)
+			if policy.Breaker != nil {
+				policy.Breaker.record(err)
+			}
+		}
+		if err == nil {
+			return result, nil
+		}
+
+		retry := policy.Retry
+		if retry == nil || attempts >= retry.MaxAttempts || !retry.retryable(err) {
+			break
+		}
+		timer := time.NewTimer(retry.delay(attempts))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, &RetryError{Attempts: attempts, Err: err}
+		}
+	}
+	return result, &RetryError{Attempts: attempts, Err: err}
+}
@@ -0,0 +1,195 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"net/http"
+	"os"
+	r "ratings_filters/rating_filter"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SignatureHeader заголовок с HMAC-SHA256 тела запроса вебхука
+const SignatureHeader = "X-Rating-Signature"
+
+// SinkMessage событие рейтинга в том виде, в каком его получают внешние потребители
+type SinkMessage struct {
+	Rating string    `json:"rating"`
+	UserID uint32    `json:"user_id"`
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+}
+
+func sinkMessages(rating string, events []r.Event) []SinkMessage {
+	now := time.Now()
+	messages := make([]SinkMessage, 0, len(events))
+	for _, e := range events {
+		messages = append(messages, SinkMessage{
+			Rating: rating,
+			UserID: e.UserID,
+			Event:  r.EventName(e.Event),
+			Time:   now,
+		})
+	}
+	return messages
+}
+
+// streamAddScript добавляем пачку событий в стрим одним вызовом, ARGV[1] - MAXLEN, 0 - без ограничения,
+// дальше по четыре значения на событие
+const streamAddScript = `local maxLen = tonumber(ARGV[1])
+for i = 2, #ARGV, 4 do
+	if maxLen > 0 then
+		redis.call("XADD", KEYS[1], "MAXLEN", "~", maxLen, "*", "rating", ARGV[i], "user_id", ARGV[i+1], "event", ARGV[i+2], "time", ARGV[i+3])
+	else
+		redis.call("XADD", KEYS[1], "*", "rating", ARGV[i], "user_id", ARGV[i+1], "event", ARGV[i+2], "time", ARGV[i+3])
+	end
+end
+return 0`
+
+// streamBatch сколько событий добавляем в стрим одним вызовом
+const streamBatch = 1000
+
+// RedisStreamSink пишем события в стрим редис через XADD пачками, maxLen > 0 примерно ограничивает длину стрима
+func RedisStreamSink(pool redis.Pool, stream, rating string, maxLen int64) func(ctx context.Context, e []r.Event) error {
+	return func(ctx context.Context, events []r.Event) error {
+		messages := sinkMessages(rating, events)
+		for len(messages) > 0 {
+			n := len(messages)
+			if n > streamBatch {
+				n = streamBatch
+			}
+			args := redis.Args{}.Add(streamAddScript, 1, stream, maxLen)
+			for _, m := range messages[:n] {
+				args = args.Add(m.Rating, m.UserID, m.Event, m.Time.Unix())
+			}
+			_, err := doContext(ctx, pool, "EVAL", args...)
+			if err != nil {
+				return errors.WithMessage(err, "cannot add events to stream")
+			}
+			messages = messages[n:]
+		}
+		return nil
+	}
+}
+
+// KafkaWriter продюсер кафки, *kafka.Writer подходит без обёртки, в тестах подменяется
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// KafkaSink пишем события в кафку одним вызовом, ключ сообщения - пользователь, чтобы его события шли по порядку
+func KafkaSink(writer KafkaWriter, rating string) func(ctx context.Context, e []r.Event) error {
+	return func(ctx context.Context, events []r.Event) error {
+		messages := make([]kafka.Message, 0, len(events))
+		for _, m := range sinkMessages(rating, events) {
+			b, err := json.Marshal(m)
+			if err != nil {
+				return errors.WithMessage(err, "cannot marshal event")
+			}
+			messages = append(messages, kafka.Message{
+				Key:   []byte(strconv.FormatUint(uint64(m.UserID), 10)),
+				Value: b,
+			})
+		}
+		err := writer.WriteMessages(ctx, messages...)
+		if err != nil {
+			return errors.WithMessage(err, "cannot write events to kafka")
+		}
+		return nil
+	}
+}
+
+// WebhookSink отправляем события JSON массивом POST запросом, тело подписывается HMAC-SHA256 секретом
+func WebhookSink(url string, secret []byte, client *http.Client, rating string) func(ctx context.Context, e []r.Event) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, events []r.Event) error {
+		body, err := json.Marshal(sinkMessages(rating, events))
+		if err != nil {
+			return errors.WithMessage(err, "cannot marshal events")
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return errors.WithMessage(err, "cannot create webhook request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(SignatureHeader, "sha256="+SignWebhook(secret, body))
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.WithMessage(err, "cannot send webhook")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.Errorf("webhook responded %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// SignWebhook подпись тела вебхука, получатель сверяет её через hmac.Equal
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// FileSink дописываем события в файл по одному JSON в строке
+func FileSink(path, rating string) func(ctx context.Context, e []r.Event) error {
+	var mu sync.Mutex
+	return func(ctx context.Context, events []r.Event) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, m := range sinkMessages(rating, events) {
+			err := enc.Encode(m)
+			if err != nil {
+				return errors.WithMessage(err, "cannot marshal event")
+			}
+		}
+
+		// пачки могут обрабатываться параллельно, строки разных пачек не должны перемешиваться
+		mu.Lock()
+		defer mu.Unlock()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.WithMessage(err, "cannot open events file")
+		}
+		_, err = f.Write(buf.Bytes())
+		if err != nil {
+			f.Close()
+			return errors.WithMessage(err, "cannot write events file")
+		}
+		return f.Close()
+	}
+}
+
+// FanOutSink отправляем события во все sinks параллельно, ошибки всех sinks объединяются
+func FanOutSink(sinks ...func(ctx context.Context, e []r.Event) error) func(ctx context.Context, e []r.Event) error {
+	return func(ctx context.Context, events []r.Event) error {
+		errs := make([]error, len(sinks))
+		var wg sync.WaitGroup
+		for i, sink := range sinks {
+			wg.Add(1)
+			go func(i int, sink func(ctx context.Context, e []r.Event) error) {
+				defer wg.Done()
+				errs[i] = sink(ctx, events)
+			}(i, sink)
+		}
+		wg.Wait()
+		return stderrors.Join(errs...)
+	}
+}
@@ -0,0 +1,119 @@
+package helpers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	r "ratings_filters/rating_filter"
+	"testing"
+)
+
+var sinkEvents = []r.Event{
+	{UserID: 1, Event: r.Entered},
+	{UserID: 10, Event: r.MoveUp},
+	{UserID: 25, Event: r.Out},
+}
+
+type testKafkaWriter struct {
+	messages []kafka.Message
+}
+
+func (w *testKafkaWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("secret")
+	// обработчик работает в другой горутине, проверяем запрос в горутине теста
+	type request struct {
+		body      []byte
+		signature string
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- request{body: body, signature: req.Header.Get(SignatureHeader)}
+	}))
+	defer server.Close()
+
+	err := WebhookSink(server.URL, secret, nil, "likes")(context.TODO(), sinkEvents)
+	require.NoError(t, err)
+	req := <-requests
+	body := req.body
+	require.Equal(t, "sha256="+SignWebhook(secret, body), req.signature)
+	var received []SinkMessage
+	require.NoError(t, json.Unmarshal(body, &received))
+	require.Len(t, received, 3)
+	require.Equal(t, "likes", received[0].Rating)
+	require.Equal(t, uint32(10), received[1].UserID)
+	require.Equal(t, "move_up", received[1].Event)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	err = WebhookSink(failing.URL, secret, nil, "likes")(context.TODO(), sinkEvents)
+	require.Error(t, err)
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	sink := FileSink(path, "likes")
+	require.NoError(t, sink(context.TODO(), sinkEvents[:2]))
+	require.NoError(t, sink(context.TODO(), sinkEvents[2:]))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var lines []SinkMessage
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m SinkMessage
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &m))
+		lines = append(lines, m)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, lines, 3)
+	require.Equal(t, "out", lines[2].Event)
+}
+
+func TestKafkaAndFanOutSink(t *testing.T) {
+	writer := &testKafkaWriter{}
+	failing := func(context.Context, []r.Event) error {
+		return fmt.Errorf("sink unavailable")
+	}
+
+	sink := FanOutSink(
+		KafkaSink(writer, "likes"),
+		RedisStreamSink(redisTest, "rating-events", "likes", 1000),
+	)
+	require.NoError(t, sink(context.TODO(), sinkEvents))
+	require.Len(t, writer.messages, 3)
+	require.Equal(t, "25", string(writer.messages[2].Key))
+
+	fromStream, err := redis.Values(redisTest.Do(0, "XRANGE", "rating-events", "-", "+"))
+	require.NoError(t, err)
+	require.Len(t, fromStream, 3)
+
+	err = FanOutSink(KafkaSink(writer, "likes"), failing)(context.TODO(), sinkEvents)
+	require.Error(t, err)
+	require.Len(t, writer.messages, 6)
+
+	// подчистим редис
+	_, err = redisTest.Do(0, "FLUSHDB")
+	require.NoError(t, err)
+}
@@ -0,0 +1,216 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	approto "proto-compile"
+)
+
+// первый байт снапшота определяет кодек, старые JSON снапшоты заголовка не имеют
+const (
+	codecProto  byte = 1
+	codecDelta  byte = 2
+	codecZstd   byte = 3
+	codecSnappy byte = 4
+)
+
+// protoItemsKey ключ поля repeated RatingItem Items = 1, формат совпадает с сообщением-списком
+const protoItemsKey = 1<<3 | proto.WireBytes
+
+// SnapshotCodec кодирует снапшот рейтинга для хранения в редис,
+// декодирование общее для всех кодеков, см. DecodeSnapshot
+type SnapshotCodec interface {
+	Encode(rating []*approto.RatingItem) ([]byte, error)
+}
+
+var (
+	// JSONCodec исторический формат без заголовка
+	JSONCodec SnapshotCodec = jsonCodec{}
+	// ProtoCodec список RatingItem в wire формате protobuf
+	ProtoCodec SnapshotCodec = protoCodec{}
+	// DeltaCodec места, пользователи и очки разностями от предыдущего в varint,
+	// пустые поля RatingItem сохраняются как нули
+	DeltaCodec SnapshotCodec = deltaCodec{}
+)
+
+// ZstdCodec сжимает результат inner через zstd
+func ZstdCodec(inner SnapshotCodec) SnapshotCodec {
+	return compressCodec{id: codecZstd, inner: inner}
+}
+
+// SnappyCodec сжимает результат inner через snappy
+func SnappyCodec(inner SnapshotCodec) SnapshotCodec {
+	return compressCodec{id: codecSnappy, inner: inner}
+}
+
+// DecodeSnapshot определяет кодек по заголовку и декодирует снапшот
+func DecodeSnapshot(b []byte) ([]*approto.RatingItem, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty snapshot")
+	}
+	switch b[0] {
+	case '[', 'n':
+		var rating []*approto.RatingItem
+		err := json.Unmarshal(b, &rating)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot unmarshal json snapshot")
+		}
+		return rating, nil
+	case codecProto:
+		return decodeProto(b[1:])
+	case codecDelta:
+		return decodeDelta(b[1:])
+	case codecZstd:
+		inner, err := zstdDecoder.DecodeAll(b[1:], nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot decompress zstd snapshot")
+		}
+		return DecodeSnapshot(inner)
+	case codecSnappy:
+		inner, err := snappy.Decode(nil, b[1:])
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot decompress snappy snapshot")
+		}
+		return DecodeSnapshot(inner)
+	}
+	return nil, errors.Errorf("unknown snapshot codec %d", b[0])
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(rating []*approto.RatingItem) ([]byte, error) {
+	return json.Marshal(rating)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Encode(rating []*approto.RatingItem) ([]byte, error) {
+	buf := proto.NewBuffer([]byte{codecProto})
+	for _, item := range rating {
+		err := buf.EncodeVarint(protoItemsKey)
+		if err != nil {
+			return nil, err
+		}
+		err = buf.EncodeMessage(item)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot marshal rating item")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeProto(b []byte) ([]*approto.RatingItem, error) {
+	var rating []*approto.RatingItem
+	buf := proto.NewBuffer(b)
+	for len(buf.Unread()) > 0 {
+		key, err := buf.DecodeVarint()
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot read proto snapshot")
+		}
+		if key != protoItemsKey {
+			return nil, errors.Errorf("unexpected proto snapshot field %d", key)
+		}
+		raw, err := buf.DecodeRawBytes(false)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot read proto snapshot")
+		}
+		item := &approto.RatingItem{}
+		err = proto.Unmarshal(raw, item)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot unmarshal rating item")
+		}
+		rating = append(rating, item)
+	}
+	return rating, nil
+}
+
+type deltaCodec struct{}
+
+func (deltaCodec) Encode(rating []*approto.RatingItem) ([]byte, error) {
+	b := make([]byte, 0, 1+binary.MaxVarintLen64*(1+3*len(rating)))
+	b = append(b, codecDelta)
+	b = appendUvarint(b, uint64(len(rating)))
+
+	var prevRank, prevUserID, prevValue int64
+	for _, item := range rating {
+		rank, userID, value := int64(item.GetRank()), int64(item.GetUserID()), item.GetValue()
+		b = appendVarint(b, rank-prevRank)
+		b = appendVarint(b, userID-prevUserID)
+		b = appendVarint(b, value-prevValue)
+		prevRank, prevUserID, prevValue = rank, userID, value
+	}
+	return b, nil
+}
+
+func decodeDelta(b []byte) ([]*approto.RatingItem, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("cannot read delta snapshot size")
+	}
+	b = b[n:]
+
+	// в каждом элементе минимум три байта, не даём битому размеру раздуть память
+	if size > uint64(len(b)/3) {
+		return nil, errors.Errorf("delta snapshot size %d exceeds payload", size)
+	}
+	rating := make([]*approto.RatingItem, 0, size)
+	var fields [3]int64
+	for i := uint64(0); i < size; i++ {
+		for f := range fields {
+			delta, n := binary.Varint(b)
+			if n <= 0 {
+				return nil, errors.Errorf("cannot read delta snapshot item %d", i)
+			}
+			fields[f] += delta
+			b = b[n:]
+		}
+		rating = append(rating, &approto.RatingItem{
+			Rank:   proto.Uint32(uint32(fields[0])),
+			UserID: proto.Uint32(uint32(fields[1])),
+			Value:  proto.Int64(fields[2]),
+		})
+	}
+	if len(b) != 0 {
+		return nil, errors.New("trailing bytes in delta snapshot")
+	}
+	return rating, nil
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// кодеры zstd потокобезопасны для EncodeAll/DecodeAll, ошибки возможны только на опциях
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type compressCodec struct {
+	id    byte
+	inner SnapshotCodec
+}
+
+func (c compressCodec) Encode(rating []*approto.RatingItem) ([]byte, error) {
+	inner, err := c.inner.Encode(rating)
+	if err != nil {
+		return nil, err
+	}
+	switch c.id {
+	case codecZstd:
+		return zstdEncoder.EncodeAll(inner, []byte{codecZstd}), nil
+	case codecSnappy:
+		return append([]byte{codecSnappy}, snappy.Encode(nil, inner)...), nil
+	}
+	return nil, errors.Errorf("unknown compression codec %d", c.id)
+}
@@ -0,0 +1,121 @@
+package ratiing_filter
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"log/slog"
+	approto "proto"
+	"time"
+)
+
+// StageTimeouts ограничения на время стадий GetEvent, нулевые - без ограничения
+type StageTimeouts struct {
+	// Fetch чтение предыдущего рейтинга или карты чанков
+	Fetch time.Duration
+	// Process обработка событий
+	Process time.Duration
+	// Save сохранение рейтинга или карты чанков
+	Save time.Duration
+}
+
+// runStage выполняет стадию с её таймаутом, отмена ctx проверяется до начала стадии.
+// Callback обязан уважать ctx: стадию дожидаемся, чтобы после возврата GetEvent и снятия
+// блокировки ничего не продолжало писать в хранилище или получателям
+func runStage[T any](ctx context.Context, timeout time.Duration, stage func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return stage(ctx)
+}
+
+func (s ScopeEvent) fetchRating(ctx context.Context) ([]*approto.RatingItem, error) {
+	ctx, st := startStage(ctx, s.Logger, "fetch")
+	rating, err := runPolicy(ctx, s.Timeouts.Fetch, s.Policies.Fetch, s.RatingFetcher)
+	if errors.Cause(err) == ErrNotFound {
+		st.end(ctx, nil, "found", false)
+	} else {
+		st.end(ctx, err, "users", len(rating))
+	}
+	return rating, err
+}
+
+func (s ScopeEvent) saveRating(ctx context.Context, rating []*approto.RatingItem) error {
+	ctx, st := startStage(ctx, s.Logger, "save")
+	_, err := runPolicy(ctx, s.Timeouts.Save, s.Policies.Save, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.RatingSaver(ctx, rating)
+	})
+	st.end(ctx, err, "users", len(rating))
+	return err
+}
+
+func (s ScopeEvent) fetchChunks(ctx context.Context, current map[uint32]int) (map[uint32]int, error) {
+	ctx, st := startStage(ctx, s.Logger, "fetch")
+	chunks, err := runPolicy(ctx, s.Timeouts.Fetch, s.Policies.Fetch, func(ctx context.Context) (map[uint32]int, error) {
+		return s.ChunkFetcher(ctx, current)
+	})
+	if errors.Cause(err) == ErrNotFound {
+		st.end(ctx, nil, "found", false)
+	} else {
+		st.end(ctx, err, "users", len(chunks))
+	}
+	return chunks, err
+}
+
+func (s ScopeEvent) saveChunks(ctx context.Context, changed map[uint32]int, removed []uint32) error {
+	ctx, st := startStage(ctx, s.Logger, "save")
+	_, err := runPolicy(ctx, s.Timeouts.Save, s.Policies.Save, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.ChunkSaver(ctx, changed, removed)
+	})
+	st.end(ctx, err, "changed", len(changed), "removed", len(removed))
+	return err
+}
+
+func (s ScopeEvent) processEvents(ctx context.Context, events []Event) error {
+	ctx, st := startStage(ctx, s.Logger, "process")
+	var err error
+	if s.Batch.Size > 0 && len(events) > s.Batch.Size {
+		err = s.processBatches(ctx, events)
+	} else {
+		err = s.processBatch(ctx, events)
+	}
+	st.end(ctx, err, "events", len(events))
+	return err
+}
+
+// filterStage filterRating со своей стадией
+func filterStage(ctx context.Context, logger *slog.Logger, rating []*approto.RatingItem, filter func(item *approto.RatingItem) bool) []*approto.RatingItem {
+	ctx, st := startStage(ctx, logger, "filter")
+	filtered := filterRating(rating, filter)
+	st.end(ctx, nil, "size", len(rating), "filtered", len(rating)-len(filtered))
+	return filtered
+}
+
+func (s ScopeEvent) convertChunks(ctx context.Context, rating []*approto.RatingItem) map[uint32]int {
+	ctx, st := startStage(ctx, s.Logger, "chunks")
+	chunks := convertRatingToChucks(rating, s.Chunks)
+	st.end(ctx, nil, "users", len(chunks))
+	return chunks
+}
+
+// buildEvents сравнение с предыдущими чанками и подавление дребезга
+func (s ScopeEvent) buildEvents(ctx context.Context, report *EventReport) error {
+	ctx, st := startStage(ctx, s.Logger, "events")
+	created := createEvents(report.CurrentChunks, report.PreviousChunks)
+	var err error
+	report.Events, report.Pending, err = s.suppress(ctx, created, report.CurrentChunks, report.FilteredRating)
+	st.end(ctx, err, "created", len(created), "events", len(report.Events), "pending", len(report.Pending))
+	return err
+}
+
+func (s ScopeEvent) processBatch(ctx context.Context, events []Event) error {
+	_, err := runPolicy(ctx, s.Timeouts.Process, s.Policies.Process, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.EventsProcessor(ctx, events)
+	})
+	return err
+}
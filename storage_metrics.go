@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+// хранилища в метке store
+const (
+	storeRedis = "redis"
+	storeMongo = "mongo"
+	storeMySQL = "mysql"
+)
+
+var (
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rating",
+		Name:      "storage_duration_seconds",
+		Help:      "Latency of Redis, Mongo and MySQL calls made by rating helpers.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"store", "op"})
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rating",
+		Name:      "storage_errors_total",
+		Help:      "Failed Redis, Mongo and MySQL calls made by rating helpers.",
+	}, []string{"store", "op"})
+)
+
+// observeStorage вызывается через defer, поэтому ошибка передаётся указателем;
+// отсутствие ключа или строк и отмена или таймаут запуска ошибкой хранилища не считаются
+func observeStorage(store, op string, started time.Time, err *error) {
+	storageDuration.WithLabelValues(store, op).Observe(time.Since(started).Seconds())
+	if isStorageError(*err) {
+		storageErrors.WithLabelValues(store, op).Inc()
+	}
+}
+
+func isStorageError(err error) bool {
+	switch {
+	case err == nil, err == redis.ErrNil, err == sql.ErrNoRows:
+		return false
+	case stderrors.Is(err, context.Canceled), stderrors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
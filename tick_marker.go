@@ -0,0 +1,29 @@
+package helpers
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// tickPrefix отметки выполненных тиков расписания, вне шаблонов RatingKeyPattern
+const tickPrefix = "ratingtick"
+
+// TickKey ключ отметки тика tick задания name, тик с точностью до минуты, как у cron
+func TickKey(env, name string, tick time.Time) string {
+	return strings.Join([]string{tickPrefix, env, name, tick.UTC().Format("200601021504")}, ":")
+}
+
+// MarkTick отмечаем тик выполненным, false - его уже выполнил другой инстанс.
+// Отметка живёт ttl и в отличие от блокировки после запуска не снимается
+func MarkTick(ctx context.Context, pool redis.Pool, key string, ttl time.Duration) (bool, error) {
+	_, err := redis.String(doContext(ctx, pool, "SET", key, 1, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithMessage(err, "cannot mark tick")
+	}
+	return true, nil
+}
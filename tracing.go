@@ -0,0 +1,80 @@
+package ratiing_filter
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"time"
+)
+
+// tracer провайдер задаёт приложение через otel.SetTracerProvider, по умолчанию спаны не пишутся
+var tracer = otel.Tracer("ratings_filters/rating_filter")
+
+// stage стадия запуска: span трейса и строка лога по завершении
+type stage struct {
+	name    string
+	logger  *slog.Logger
+	span    trace.Span
+	started time.Time
+}
+
+func startStage(ctx context.Context, logger *slog.Logger, name string) (context.Context, *stage) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, &stage{name: name, logger: logger, span: span, started: time.Now()}
+}
+
+// end завершаем стадию, attrs - пары ключ-значение как в slog, попадают и в лог, и в span;
+// ошибки стадий - Warn, итог запуска пишут GetEvent и GetRewardUsers
+func (st *stage) end(ctx context.Context, err error, attrs ...any) {
+	st.span.SetAttributes(spanAttributes(attrs)...)
+	attrs = append(attrs, "stage", st.name, "duration", time.Since(st.started))
+	if err != nil {
+		st.span.RecordError(err)
+		st.span.SetStatus(codes.Error, err.Error())
+		st.logger.WarnContext(ctx, "stage failed", append(attrs, "error", err)...)
+	} else {
+		st.logger.DebugContext(ctx, "stage done", attrs...)
+	}
+	st.span.End()
+}
+
+// endSpan завершаем span всего запуска
+func endSpan(span trace.Span, err error, attrs ...any) {
+	span.SetAttributes(spanAttributes(attrs)...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// spanAttributes пары ключ-значение slog в атрибуты span, ключи получают префикс rating.
+func spanAttributes(attrs []any) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key, ok := attrs[i].(string)
+		if !ok {
+			continue
+		}
+		key = "rating." + key
+		switch v := attrs[i+1].(type) {
+		case int:
+			kvs = append(kvs, attribute.Int(key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(key, v))
+		case string:
+			kvs = append(kvs, attribute.String(key, v))
+		case time.Duration:
+			kvs = append(kvs, attribute.String(key, v.String()))
+		}
+	}
+	return kvs
+}
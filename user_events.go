@@ -0,0 +1,95 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	r "ratings_filters/rating_filter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userEventsPrefix префикс истории событий пользователя, отдельный от keyPrefix,
+// чтобы CleanupRatingKeys и SCAN по рейтингам её не задевали
+const userEventsPrefix = "ratingevents"
+
+// DefaultUserEventsLen сколько последних событий хранится у пользователя по умолчанию
+const DefaultUserEventsLen = 100
+
+// UserEvent событие в истории пользователя
+type UserEvent struct {
+	SinkMessage
+	PreviousChunk int `json:"previous_chunk"`
+	CurrentChunk  int `json:"current_chunk"`
+}
+
+// UserEventsKey ключ истории событий пользователя по всем рейтингам окружения
+func UserEventsKey(env string, userID uint32) string {
+	return strings.Join([]string{userEventsPrefix, env, strconv.FormatUint(uint64(userID), 10)}, ":")
+}
+
+// pushUserEventsScript ARGV[1] длина истории, ARGV[2] ttl в мс, 0 - без ttl, дальше события от старых к новым
+const pushUserEventsScript = `redis.call("LPUSH", KEYS[1], unpack(ARGV, 3))
+redis.call("LTRIM", KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if tonumber(ARGV[2]) > 0 then redis.call("PEXPIRE", KEYS[1], ARGV[2]) end
+return 1`
+
+// UserEventsSink пишем события в историю каждого пользователя, новые в начале списка,
+// maxLen <= 0 - DefaultUserEventsLen, ttl > 0 - история удаляется, если событий не было ttl.
+// События одного пользователя пишутся одним EVAL
+func UserEventsSink(pool redis.Pool, env, rating string, maxLen int64, ttl time.Duration) func(ctx context.Context, e []r.Event) error {
+	if maxLen <= 0 {
+		maxLen = DefaultUserEventsLen
+	}
+	return func(ctx context.Context, events []r.Event) error {
+		var users []uint32
+		byUser := make(map[uint32][]interface{})
+		for i, m := range sinkMessages(rating, events) {
+			b, err := json.Marshal(UserEvent{
+				SinkMessage:   m,
+				PreviousChunk: events[i].PreviousChunk,
+				CurrentChunk:  events[i].CurrentChunk,
+			})
+			if err != nil {
+				return errors.WithMessage(err, "cannot marshal user event")
+			}
+			if _, ok := byUser[m.UserID]; !ok {
+				users = append(users, m.UserID)
+			}
+			byUser[m.UserID] = append(byUser[m.UserID], b)
+		}
+
+		for _, userID := range users {
+			args := redis.Args{}.Add(pushUserEventsScript, 1, UserEventsKey(env, userID), maxLen, ttl.Milliseconds())
+			_, err := doContext(ctx, pool, "EVAL", append(args, byUser[userID]...)...)
+			if err != nil {
+				return errors.WithMessage(err, "cannot save user events")
+			}
+		}
+		return nil
+	}
+}
+
+// GetUserEvents последние limit событий пользователя, новые первыми, limit <= 0 - все
+func GetUserEvents(ctx context.Context, pool redis.Pool, env string, userID uint32, limit int) ([]UserEvent, error) {
+	stop := limit - 1
+	if limit <= 0 {
+		stop = -1
+	}
+	values, err := redis.ByteSlices(doContext(ctx, pool, "LRANGE", UserEventsKey(env, userID), 0, stop))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot get user events")
+	}
+	events := make([]UserEvent, 0, len(values))
+	for _, b := range values {
+		var e UserEvent
+		err = json.Unmarshal(b, &e)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot unmarshal user event")
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}